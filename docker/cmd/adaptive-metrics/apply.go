@@ -2,47 +2,88 @@ package main
 
 import (
 	"bytes"
-	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"log"
-	"net/http"
 	"os"
+	"path/filepath"
+	"slices"
 	"strconv"
 
 	"github.com/grafana/adaptive-metrics-autoapply/docker/internal"
 )
 
+// applyOptions control how applySegment applies the rules of a segment.
+type applyOptions struct {
+	managedBy    string
+	dryRun       bool
+	seriesImpact bool
+
+	plugins   *pluginsConfig
+	protected *protectedLabelsConfig
+
+	// fetchSeries fetches the series counts of every segment, not only of the changed ones.
+	fetchSeries bool
+}
+
 func apply(args []string) {
-	defaultDryRun := false
-	if dryRunEnvVar := os.Getenv("INPUT_DRY-RUN"); dryRunEnvVar != "" {
-		var err error
-		defaultDryRun, err = strconv.ParseBool(dryRunEnvVar)
+	runApply("apply", args, false)
+}
+
+// runApply applies the rule files. The plan command runs it with plan set, which always skips applying the changes.
+func runApply(command string, args []string, plan bool) {
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	cfg := loadConfig(flags, args)
+	workingDir := flags.String("working-dir", cfg.get(settingWorkingDir), "The path to the working directory.")
+	dryRun := &plan
+	if !plan {
+		dryRun = flags.Bool("dry-run", cfg.getBool(settingDryRun), "dry run; print changes but do not apply them")
+	}
+	userAgent := flags.String("user-agent", cfg.get(settingUserAgent), "The user-agent to use when making requests against the API.")
+	managedBy := flags.String("managed-by", cfg.get(settingManagedBy), "The tag to use when setting the managed_by field on rules.")
+	diffFile := flags.String("diff-file", cfg.get(settingDiffFile), "Optionally write the detected changes as JSON to this file.")
+	seriesImpact := flags.Bool("series-impact", cfg.getBool(settingSeriesImpact), "Annotate changed rules with series counts and usages from the recommendations.")
+	pluginsFile := flags.String("plugins-file", cfg.get(settingPluginsFile), "Optionally run the policy plugins configured in this JSON or YAML file on the planned changes.")
+	protectedLabelsFile := flags.String("protected-labels-file", cfg.get(settingProtectedLabelsFile), "Optionally reject rules that aggregate away the labels protected in this JSON or YAML file.")
+	pricingFile := flags.String("pricing-file", cfg.get(settingPricingFile), "Optionally estimate the monthly cost with the pricing config in this JSON or YAML file. Implies -series-impact.")
+
+	err := flags.Parse(args)
+	if err != nil {
+		log.Fatalf("failed to parse flags: %v", err)
+	}
+
+	// The diff file is relative to where we were started, not to the working directory.
+	diffPath := *diffFile
+	if diffPath != "" {
+		diffPath, err = filepath.Abs(diffPath)
 		if err != nil {
-			log.Fatalf("error parsing INPUT_DRY-RUN: %s", err)
+			log.Fatalf("failed to resolve -diff-file: %v", err)
 		}
 	}
 
-	defaultWorkingDir := "./"
-	if workingDirEnvVar := os.Getenv("INPUT_WORKING-DIR"); workingDirEnvVar != "" {
-		defaultWorkingDir = workingDirEnvVar
+	var plugins *pluginsConfig
+	if *pluginsFile != "" {
+		plugins, err = readPluginsConfig(*pluginsFile)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
 	}
 
-	defaultManagedBy := "gh-action-autoapply"
-	if managedByEnvVar := os.Getenv("INPUT_MANAGED-BY"); managedByEnvVar != "" {
-		defaultManagedBy = managedByEnvVar
+	var protected *protectedLabelsConfig
+	if *protectedLabelsFile != "" {
+		protected, err = readProtectedLabels(*protectedLabelsFile)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
 	}
 
-	flags := flag.NewFlagSet("apply", flag.ExitOnError)
-	workingDir := flags.String("working-dir", defaultWorkingDir, "The path to the working directory.")
-	dryRun := flags.Bool("dry-run", defaultDryRun, "dry run; print changes but do not apply them")
-	userAgent := flags.String("user-agent", "gh-action-autoapply", "The user-agent to use when making requests against the API.")
-	managedBy := flags.String("managed-by", defaultManagedBy, "The tag to use when setting the managed_by field on rules.")
-
-	err := flags.Parse(args)
-	if err != nil {
-		log.Fatalf("failed to parse flags: %v", err)
+	var pricing *pricingConfig
+	if *pricingFile != "" {
+		pricing, err = readPricingConfig(*pricingFile)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
 	}
 
 	err = os.Chdir(*workingDir)
@@ -50,31 +91,48 @@ func apply(args []string) {
 		log.Fatalf("failed to change working directory: %v", err)
 	}
 
-	apiURL := mustGetEnv("GRAFANA_AM_API_URL")
-	apiKey := mustGetEnv("GRAFANA_AM_API_KEY")
-
-	c := internal.NewClient(&http.Client{}, *userAgent, apiURL, apiKey)
+	c := newClient(cfg, *userAgent)
 
 	segments, err := c.FetchSegments()
 	if err != nil {
 		log.Fatalf("failed to read segments: %v", err)
 	}
 	segments = append(segments, internal.DefaultSegment)
+	if protected != nil {
+		for _, u := range protected.unknownSegments(segments) {
+			log.Printf("warning: %s", u)
+		}
+	}
+
+	manifest, err := readSegmentManifest(".")
+	if err != nil {
+		log.Fatalf("failed to read manifest: %v", err)
+	}
 
 	totalChanges := 0
 	changedSegments := 0
 	stepSummary := new(bytes.Buffer)
+	var allChanges []segmentDiff
 
+	opts := applyOptions{
+		managedBy:    *managedBy,
+		dryRun:       *dryRun,
+		seriesImpact: *seriesImpact || pricing != nil,
+		fetchSeries:  pricing != nil,
+		plugins:      plugins,
+		protected:    protected,
+	}
 	for _, segment := range segments {
-		changes, err := applySegment(stepSummary, c, segment, *managedBy, *dryRun)
+		diff, err := applySegment(stepSummary, c, manifest, segment, opts)
 		if err != nil {
 			log.Fatalf("failed to apply segment %s: %v", segment.Name, err)
 		}
 
-		if changes > 0 {
+		if diff.count() > 0 {
 			changedSegments++
 		}
-		totalChanges += changes
+		totalChanges += diff.count()
+		allChanges = append(allChanges, diff)
 	}
 
 	gha, err := newGithubActionWorkflowCommands()
@@ -88,6 +146,34 @@ func apply(args []string) {
 		log.Fatalf("failed to write changes-detected output: %v", err)
 	}
 
+	if diffPath != "" {
+		err = writeDiffFile(diffPath, allChanges)
+		if err != nil {
+			log.Fatalf("failed to write diff file: %v", err)
+		}
+
+		err = gha.writeOutput("diff-file", *diffFile)
+		if err != nil {
+			log.Fatalf("failed to write diff-file output: %v", err)
+		}
+	}
+
+	var estimate *costEstimate
+	if pricing != nil {
+		var seriesEstimates []seriesEstimate
+		for _, diff := range allChanges {
+			change, _ := diff.seriesChange()
+			seriesEstimates = append(seriesEstimates, seriesEstimate{segment: diff.segment.Name, before: diff.currentSeries, after: diff.currentSeries + change})
+		}
+		e := newCostEstimate(pricing, seriesEstimates)
+		estimate = &e
+
+		err = estimate.writeOutputs(gha)
+		if err != nil {
+			log.Fatalf("failed to write cost outputs: %v", err)
+		}
+	}
+
 	if totalChanges > 0 {
 
 		// Max summary size is 1MB, if we're close, then just write a summary.
@@ -96,10 +182,23 @@ func apply(args []string) {
 			fmt.Fprintf(stepSummary, "Skipping detailed diff because it's too large (%d bytes)\n\n", summaryLength)
 		}
 
+		var decisions []pluginDecision
+		for _, diff := range allChanges {
+			decisions = append(decisions, diff.decisions...)
+		}
+		writePluginDecisions(stepSummary, stageApply, decisions)
+		writeBiggestImpacts(stepSummary, allChanges, 20)
+		if estimate != nil {
+			estimate.write(stepSummary)
+		}
+
 		fmt.Fprintln(stepSummary, "#### Summary")
 		fmt.Fprintf(stepSummary, "- %d changes detected in aggregation rules\n", totalChanges)
 		fmt.Fprintf(stepSummary, "- %d modified segments\n", changedSegments)
 		fmt.Fprintf(stepSummary, "- %d unmodified segments\n", len(segments)-changedSegments)
+		if opts.seriesImpact {
+			fmt.Fprintf(stepSummary, "- %+d series, counting the changes with a known impact\n", netSeriesChange(allChanges))
+		}
 
 		err = gha.writeStepSummary(stepSummary.String())
 		if err != nil {
@@ -108,58 +207,91 @@ func apply(args []string) {
 	}
 }
 
-func applySegment(output io.Writer, client *internal.Client, segment internal.Segment, managedBy string, dryRun bool) (int, error) {
-	filename := fmt.Sprintf("recommendations-%s.json", segment.Name)
-	if segment == internal.DefaultSegment {
-		filename = "recommendations.json"
-	}
-
-	rules, err := readJSONFile[[]internal.Recommendation](filename)
+func applySegment(output io.Writer, client *internal.Client, manifest *segmentManifest, segment internal.Segment, opts applyOptions) (segmentDiff, error) {
+	rules, err := readSegmentRules(".", manifest, segment)
 	if err != nil {
-		if !os.IsNotExist(err) {
-			return 0, fmt.Errorf("failed to read rules: %w", err)
-		}
-		log.Printf("no rules found for segment %q", segment.Name)
-		rules = []internal.Recommendation{}
+		return segmentDiff{}, fmt.Errorf("failed to read rules: %w", err)
 	}
 
 	for i, r := range rules {
-		r.ManagedBy = managedBy
+		r.ManagedBy = opts.managedBy
 		rules[i] = r
 	}
 
-	err = client.ValidateRules(rules)
+	currentState, etag, err := client.GetRules(segment)
 	if err != nil {
-		return 0, fmt.Errorf("failed to validate rules: %w", err)
+		return segmentDiff{}, fmt.Errorf("failed to get current rules: %w", err)
 	}
 
-	currentState, etag, err := client.GetRules(segment)
-	if err != nil {
-		return 0, fmt.Errorf("failed to get current rules: %w", err)
+	// Plugins decide on the rules before they're validated, since they may modify them.
+	var decisions []pluginDecision
+	if opts.plugins != nil {
+		changes := func(rules []internal.Recommendation) []ruleChange {
+			return diffRules(segment, currentState, rules)
+		}
+		currentRule := func(rule internal.Recommendation) (internal.Recommendation, bool) {
+			i := slices.IndexFunc(currentState, func(r internal.Recommendation) bool { return ruleKey(r) == ruleKey(rule) })
+			if i < 0 {
+				return internal.Recommendation{}, false
+			}
+			return currentState[i], true
+		}
+		rules, decisions, err = opts.plugins.runPlugins(stageApply, segment, rules, changes, currentRule)
+		if err != nil {
+			return segmentDiff{}, err
+		}
+		for i, r := range rules {
+			r.ManagedBy = opts.managedBy
+			rules[i] = r
+		}
+		if rules == nil {
+			rules = []internal.Recommendation{}
+		}
 	}
 
-	changes := writeDiff(output, segment, currentState, rules)
+	if opts.protected != nil {
+		err = opts.protected.checkProtectedLabels(segment, rules)
+		if err != nil {
+			return segmentDiff{}, err
+		}
+	}
 
-	if !dryRun {
-		log.Printf("applying %d changes to segment %q", changes, segment.Name)
-		return changes, client.UpdateRules(segment, etag, rules)
+	err = client.ValidateRules(rules)
+	if err != nil {
+		return segmentDiff{}, fmt.Errorf("failed to validate rules: %w", err)
 	}
 
-	log.Printf("detected %d changes to segment %q; skipping due to -dry-run flag", changes, segment.Name)
-	return changes, nil
-}
+	diff := diffSegment(segment, currentState, rules)
+	diff.decisions = decisions
+	if opts.fetchSeries || (opts.seriesImpact && diff.count() > 0) {
+		recs, err := client.FetchRecommendations(segment, true)
+		if err != nil {
+			return segmentDiff{}, fmt.Errorf("failed to fetch recommendations: %w", err)
+		}
+		diff.currentSeries = totalSeriesForSegment(recs)
+		diff.addSeriesImpact(recs, rules)
+	}
+	writeDiff(output, diff)
 
-func readJSONFile[T any](path string) (T, error) {
-	var result T
-	file, err := os.Open(path)
-	if err != nil {
-		return result, err
+	if diff.count() == 0 {
+		log.Printf("no changes to segment %q", segment.Name)
+		return diff, nil
 	}
 
-	err = json.NewDecoder(file).Decode(&result)
-	if err != nil {
-		return result, err
+	if !opts.dryRun {
+		log.Printf("applying %d changes to segment %q", diff.count(), segment.Name)
+		return diff, client.UpdateRules(segment, etag, rules)
 	}
 
-	return result, nil
+	log.Printf("detected %d changes to segment %q; skipping due to -dry-run flag", diff.count(), segment.Name)
+	return diff, nil
+}
+
+func netSeriesChange(diffs []segmentDiff) int {
+	total := 0
+	for _, diff := range diffs {
+		change, _ := diff.seriesChange()
+		total += change
+	}
+	return total
 }
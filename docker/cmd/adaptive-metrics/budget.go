@@ -0,0 +1,306 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/grafana/adaptive-metrics-autoapply/docker/internal"
+)
+
+// budgetConfig sets series targets, so that pull only adopts as many recommendations as needed to meet them. A
+// target is either a maximum number of series or a reduction. Without a total target, segments without a target of
+// their own adopt all recommendations.
+type budgetConfig struct {
+	MaxSeries int             `json:"max_series,omitempty" yaml:"max_series,omitempty"`
+	ReduceBy  int             `json:"reduce_by,omitempty" yaml:"reduce_by,omitempty"`
+	Segments  []segmentBudget `json:"segments,omitempty" yaml:"segments,omitempty"`
+	Weights   *usageWeights   `json:"usage_weights,omitempty" yaml:"usage_weights,omitempty"`
+}
+
+// segmentBudget is the target of one segment, by name or, to survive renames, by ID.
+type segmentBudget struct {
+	Segment   string `json:"segment,omitempty" yaml:"segment,omitempty"`
+	ID        string `json:"id,omitempty" yaml:"id,omitempty"`
+	MaxSeries int    `json:"max_series,omitempty" yaml:"max_series,omitempty"`
+	ReduceBy  int    `json:"reduce_by,omitempty" yaml:"reduce_by,omitempty"`
+}
+
+// usageWeights weigh the usages of a metric into the risk of changing it.
+type usageWeights struct {
+	Rules      float64 `json:"rules" yaml:"rules"`
+	Queries    float64 `json:"queries" yaml:"queries"`
+	Dashboards float64 `json:"dashboards" yaml:"dashboards"`
+}
+
+var defaultUsageWeights = usageWeights{Rules: 3, Queries: 1, Dashboards: 2}
+
+func readBudgetConfig(file string) (*budgetConfig, error) {
+	b, err := readConfigFile[budgetConfig](file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read budget config: %w", err)
+	}
+
+	if b.MaxSeries != 0 && b.ReduceBy != 0 {
+		return nil, fmt.Errorf("invalid budget config: set either max_series or reduce_by")
+	}
+	for _, s := range b.Segments {
+		if s.Segment == "" && s.ID == "" {
+			return nil, fmt.Errorf("invalid budget config: set segment or id for each segment target")
+		}
+		if s.MaxSeries != 0 && s.ReduceBy != 0 {
+			return nil, fmt.Errorf("invalid budget config: set either max_series or reduce_by for segment %q", cmp.Or(s.Segment, s.ID))
+		}
+	}
+	if b.Weights == nil {
+		b.Weights = &defaultUsageWeights
+	}
+	return &b, nil
+}
+
+// unknownSegments describes the segment targets that match none of the segments, for example after a rename.
+func (b *budgetConfig) unknownSegments(segments []internal.Segment) []string {
+	var unknown []string
+	for _, s := range b.Segments {
+		if !slices.ContainsFunc(segments, func(segment internal.Segment) bool { return matchesSegment(s.Segment, s.ID, segment) }) {
+			unknown = append(unknown, fmt.Sprintf("the budget of segment %s doesn't match any segment, so it doesn't apply", describeSegmentRef(s.Segment, s.ID)))
+		}
+	}
+	return unknown
+}
+
+// matchesSegment reports whether a config entry for the segment with the given name or ID refers to segment. The ID
+// takes precedence, since it doesn't change when the segment is renamed.
+func matchesSegment(name, id string, segment internal.Segment) bool {
+	if id != "" {
+		return id == segment.Identifier
+	}
+	return name == segment.Name
+}
+
+func describeSegmentRef(name, id string) string {
+	if id != "" {
+		return fmt.Sprintf("with id %q", id)
+	}
+	return fmt.Sprintf("%q", name)
+}
+
+// budgetReduction returns how many series must be saved to meet the target, given the current number of series.
+func budgetReduction(current, maxSeries, reduceBy int) int {
+	if maxSeries != 0 {
+		return max(current-maxSeries, 0)
+	}
+	return reduceBy
+}
+
+// budgetCandidate is a recommendation that saves series, and may be deferred if the budget is met without it.
+type budgetCandidate struct {
+	segment int
+	rec     internal.Recommendation
+	savings int
+	score   float64
+}
+
+type budgetResult struct {
+	target           string
+	wanted, achieved int
+}
+
+func (r budgetResult) met() bool {
+	return r.achieved >= r.wanted
+}
+
+// budgetSelection holds the recommendations that were deferred because the targets are met without them.
+type budgetSelection struct {
+	results  []budgetResult
+	deferred []budgetCandidate
+}
+
+func (s budgetSelection) met() bool {
+	for _, r := range s.results {
+		if !r.met() {
+			return false
+		}
+	}
+	return true
+}
+
+func (s budgetSelection) isDeferred(segment int, rec internal.Recommendation) bool {
+	for _, c := range s.deferred {
+		if c.segment == segment && ruleKey(c.rec) == ruleKey(rec) {
+			return true
+		}
+	}
+	return false
+}
+
+// selectRecommendations picks recommendations until the targets are met, and defers the others. Recommendations that
+// don't save series, like removing a rule, are always adopted.
+//
+// Finding the smallest or least risky set of recommendations that meets a target is a knapsack problem, so this is a
+// greedy approximation: it adopts the recommendations that save the most series per risk first, then defers again
+// the adopted ones that the target is met without, starting from the riskiest. The result can still have more
+// changes, or break more usages, than the best possible set.
+func (b *budgetConfig) selectRecommendations(segments []internal.Segment, recs [][]internal.Recommendation) budgetSelection {
+	var selection budgetSelection
+	achieved := make([]int, len(segments))
+	candidates := make([][]budgetCandidate, len(segments))
+	totalCurrent := 0
+
+	for i := range segments {
+		totalCurrent += totalSeriesForSegment(recs[i])
+		for _, rec := range recs[i] {
+			if rec.RecommendedAction == "keep" {
+				continue
+			}
+			savings := rec.CurrentSeriesCount - rec.RecommendedSeriesCount
+			if savings <= 0 {
+				achieved[i] += savings
+				continue
+			}
+			candidates[i] = append(candidates[i], budgetCandidate{
+				segment: i,
+				rec:     rec,
+				savings: savings,
+				score:   float64(savings) / (1 + b.Weights.risk(rec)),
+			})
+		}
+		slices.SortStableFunc(candidates[i], compareBudgetCandidates)
+	}
+
+	// pick adopts candidates until the wanted reduction is achieved, and returns the ones left over.
+	pick := func(pool []budgetCandidate, wanted int, achievedSoFar func() int) []budgetCandidate {
+		var picked []budgetCandidate
+		for len(pool) > 0 && achievedSoFar() < wanted {
+			achieved[pool[0].segment] += pool[0].savings
+			picked = append(picked, pool[0])
+			pool = pool[1:]
+		}
+		// A candidate picked late may save enough series to make earlier ones unnecessary.
+		for j := len(picked) - 1; j >= 0; j-- {
+			if c := picked[j]; achievedSoFar()-c.savings >= wanted {
+				achieved[c.segment] -= c.savings
+				pool = append(pool, c)
+			}
+		}
+		return pool
+	}
+	sum := func() int {
+		total := 0
+		for _, a := range achieved {
+			total += a
+		}
+		return total
+	}
+
+	hasTotal := b.MaxSeries != 0 || b.ReduceBy != 0
+	var leftover []budgetCandidate
+	for i, segment := range segments {
+		idx := slices.IndexFunc(b.Segments, func(s segmentBudget) bool { return matchesSegment(s.Segment, s.ID, segment) })
+		switch {
+		case idx >= 0:
+			target := b.Segments[idx]
+			wanted := budgetReduction(totalSeriesForSegment(recs[i]), target.MaxSeries, target.ReduceBy)
+			leftover = append(leftover, pick(candidates[i], wanted, func() int { return achieved[i] })...)
+			selection.results = append(selection.results, budgetResult{
+				target:   fmt.Sprintf("segment %q", segment.Name),
+				wanted:   wanted,
+				achieved: achieved[i],
+			})
+		case hasTotal:
+			leftover = append(leftover, candidates[i]...)
+		default:
+			for _, c := range candidates[i] {
+				achieved[i] += c.savings
+			}
+		}
+	}
+
+	if hasTotal {
+		slices.SortStableFunc(leftover, compareBudgetCandidates)
+		wanted := budgetReduction(totalCurrent, b.MaxSeries, b.ReduceBy)
+		leftover = pick(leftover, wanted, sum)
+		selection.results = append(selection.results, budgetResult{
+			target:   "total",
+			wanted:   wanted,
+			achieved: sum(),
+		})
+	}
+
+	slices.SortStableFunc(leftover, compareBudgetCandidates)
+	selection.deferred = leftover
+	return selection
+}
+
+func compareBudgetCandidates(a, b budgetCandidate) int {
+	return cmp.Or(
+		cmp.Compare(b.score, a.score),
+		cmp.Compare(b.savings, a.savings),
+		strings.Compare(a.rec.Metric, b.rec.Metric),
+	)
+}
+
+func (w usageWeights) risk(rec internal.Recommendation) float64 {
+	return w.Rules*float64(rec.UsagesInRules) + w.Queries*float64(rec.UsagesInQueries) + w.Dashboards*float64(rec.UsagesInDashboards)
+}
+
+// deferRecommendations replaces the deferred recommendations of a segment by its previous rules. Deferred new rules
+// are left out.
+func (s budgetSelection) deferRecommendations(segment int, recs, oldRules []internal.Recommendation) []internal.Recommendation {
+	var kept []internal.Recommendation
+	for _, rec := range recs {
+		if !s.isDeferred(segment, rec) {
+			kept = append(kept, rec)
+			continue
+		}
+		if previous, ok := keepPreviousRule(rec, oldRules); ok {
+			kept = append(kept, previous)
+		}
+	}
+	return kept
+}
+
+// keepPreviousRule turns the recommendation into one that keeps the previous rule for its metric and match type. It
+// returns false if there was no previous rule.
+func keepPreviousRule(rec internal.Recommendation, oldRules []internal.Recommendation) (internal.Recommendation, bool) {
+	i := slices.IndexFunc(oldRules, func(r internal.Recommendation) bool { return ruleKey(r) == ruleKey(rec) })
+	if i < 0 {
+		return internal.Recommendation{}, false
+	}
+	return internal.Recommendation{
+		RuleData:           oldRules[i].RuleData,
+		RecommendedAction:  "keep",
+		UsagesInRules:      rec.UsagesInRules,
+		UsagesInQueries:    rec.UsagesInQueries,
+		UsagesInDashboards: rec.UsagesInDashboards,
+		RawSeriesCount:     rec.RawSeriesCount,
+		CurrentSeriesCount: rec.CurrentSeriesCount,
+		// The series stay as they are, since the rule doesn't change.
+		RecommendedSeriesCount: rec.CurrentSeriesCount,
+	}, true
+}
+
+func (s budgetSelection) write(output io.Writer, segments []internal.Segment) {
+	fmt.Fprintln(output, "## Budget")
+	fmt.Fprintln(output, "| Target | Wanted Reduction | Achieved Reduction | Met |")
+	fmt.Fprintln(output, "|--------|------------------|--------------------|-----|")
+	for _, r := range s.results {
+		met := "yes"
+		if !r.met() {
+			met = "no"
+		}
+		fmt.Fprintf(output, "| %s | %d | %d | %s |\n", r.target, r.wanted, r.achieved, met)
+	}
+
+	if len(s.deferred) == 0 {
+		return
+	}
+	fmt.Fprintln(output, "### Deferred recommendations")
+	fmt.Fprintln(output, "| Segment | Metric | Action | Series Change | Used in Rules | Used in Queries | Used in Dashboards |")
+	fmt.Fprintln(output, "|---------|--------|--------|---------------|---------------|-----------------|--------------------|")
+	for _, c := range s.deferred {
+		fmt.Fprintf(output, "| %s | %s | %s | %d | %d | %d | %d |\n", segments[c.segment].Name, c.rec.Metric, c.rec.RecommendedAction, -c.savings, c.rec.UsagesInRules, c.rec.UsagesInQueries, c.rec.UsagesInDashboards)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/grafana/adaptive-metrics-autoapply/docker/internal"
+)
+
+// budgetRec returns an update recommendation that changes the series of the metric from current to recommended.
+func budgetRec(metric string, current, recommended, dashboards int) internal.Recommendation {
+	return internal.Recommendation{
+		RuleData:               internal.RuleData{Metric: metric},
+		RecommendedAction:      "update",
+		UsagesInDashboards:     dashboards,
+		CurrentSeriesCount:     current,
+		RecommendedSeriesCount: recommended,
+	}
+}
+
+func TestSelectRecommendations(t *testing.T) {
+	segmentA := internal.Segment{Identifier: "a", Name: "a"}
+	segmentB := internal.Segment{Identifier: "b", Name: "b"}
+
+	tests := []struct {
+		name     string
+		budget   budgetConfig
+		segments []internal.Segment
+		recs     [][]internal.Recommendation
+		results  []budgetResult
+		deferred []string
+	}{
+		{
+			name:     "no targets adopts everything",
+			budget:   budgetConfig{},
+			segments: []internal.Segment{segmentA},
+			recs:     [][]internal.Recommendation{{budgetRec("m1", 100, 0, 0), budgetRec("m2", 50, 10, 0)}},
+		},
+		{
+			name:     "segment target adopts the best recommendations first",
+			budget:   budgetConfig{Segments: []segmentBudget{{Segment: "a", ReduceBy: 80}}},
+			segments: []internal.Segment{segmentA},
+			recs:     [][]internal.Recommendation{{budgetRec("small", 10, 0, 0), budgetRec("large", 100, 0, 0), budgetRec("medium", 50, 0, 0)}},
+			results:  []budgetResult{{target: `segment "a"`, wanted: 80, achieved: 100}},
+			deferred: []string{"medium", "small"},
+		},
+		{
+			name:     "segment target by id",
+			budget:   budgetConfig{Segments: []segmentBudget{{Segment: "renamed", ID: "a", ReduceBy: 80}}},
+			segments: []internal.Segment{segmentA},
+			recs:     [][]internal.Recommendation{{budgetRec("small", 10, 0, 0), budgetRec("large", 100, 0, 0)}},
+			results:  []budgetResult{{target: `segment "a"`, wanted: 80, achieved: 100}},
+			deferred: []string{"small"},
+		},
+		{
+			name: "usages lower the rank",
+			// used saves the most series, but its risk of 2 per dashboard makes it the worst per risk.
+			budget:   budgetConfig{Segments: []segmentBudget{{Segment: "a", ReduceBy: 50}}},
+			segments: []internal.Segment{segmentA},
+			recs:     [][]internal.Recommendation{{budgetRec("used", 90, 0, 1), budgetRec("unused", 60, 0, 0)}},
+			results:  []budgetResult{{target: `segment "a"`, wanted: 50, achieved: 60}},
+			deferred: []string{"used"},
+		},
+		{
+			name: "recommendations made unnecessary by a later one are deferred again",
+			// Greedy adopts first (60) and then large (100). The target is met with large alone.
+			budget:   budgetConfig{Segments: []segmentBudget{{Segment: "a", ReduceBy: 100}}},
+			segments: []internal.Segment{segmentA},
+			recs:     [][]internal.Recommendation{{budgetRec("first", 60, 0, 0), budgetRec("large", 100, 0, 1), budgetRec("last", 30, 0, 0)}},
+			results:  []budgetResult{{target: `segment "a"`, wanted: 100, achieved: 100}},
+			deferred: []string{"first", "last"},
+		},
+		{
+			name:     "max_series counts the current series",
+			budget:   budgetConfig{Segments: []segmentBudget{{Segment: "a", MaxSeries: 150}}},
+			segments: []internal.Segment{segmentA},
+			recs:     [][]internal.Recommendation{{budgetRec("m1", 100, 20, 0), budgetRec("m2", 100, 50, 0)}},
+			results:  []budgetResult{{target: `segment "a"`, wanted: 50, achieved: 80}},
+			deferred: []string{"m2"},
+		},
+		{
+			name:     "max_series already met defers everything",
+			budget:   budgetConfig{MaxSeries: 1000},
+			segments: []internal.Segment{segmentA},
+			recs:     [][]internal.Recommendation{{budgetRec("m1", 100, 20, 0)}},
+			results:  []budgetResult{{target: "total", wanted: 0, achieved: 0}},
+			deferred: []string{"m1"},
+		},
+		{
+			name:     "unreachable target adopts everything",
+			budget:   budgetConfig{ReduceBy: 500},
+			segments: []internal.Segment{segmentA},
+			recs:     [][]internal.Recommendation{{budgetRec("m1", 100, 0, 0), budgetRec("m2", 100, 50, 0)}},
+			results:  []budgetResult{{target: "total", wanted: 500, achieved: 150}},
+		},
+		{
+			name:     "recommendations that add series count against the target",
+			budget:   budgetConfig{Segments: []segmentBudget{{Segment: "a", ReduceBy: 50}}},
+			segments: []internal.Segment{segmentA},
+			recs: [][]internal.Recommendation{{
+				budgetRec("grows", 10, 30, 0),
+				budgetRec("m1", 40, 0, 0),
+				budgetRec("m2", 35, 0, 0),
+				{RuleData: internal.RuleData{Metric: "kept"}, RecommendedAction: "keep", CurrentSeriesCount: 1000},
+			}},
+			results: []budgetResult{{target: `segment "a"`, wanted: 50, achieved: 55}},
+		},
+		{
+			name: "total target uses what segment targets left over",
+			budget: budgetConfig{
+				ReduceBy: 150,
+				Segments: []segmentBudget{{Segment: "a", ReduceBy: 40}},
+			},
+			segments: []internal.Segment{segmentA, segmentB},
+			recs: [][]internal.Recommendation{
+				{budgetRec("a1", 50, 0, 0), budgetRec("a2", 45, 0, 0)},
+				{budgetRec("b1", 70, 0, 0), budgetRec("b2", 10, 0, 0)},
+			},
+			results: []budgetResult{
+				{target: `segment "a"`, wanted: 40, achieved: 50},
+				{target: "total", wanted: 150, achieved: 165},
+			},
+			deferred: []string{"b2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := tt.budget
+			b.Weights = &defaultUsageWeights
+			selection := b.selectRecommendations(tt.segments, tt.recs)
+
+			if diff := cmp.Diff(tt.results, selection.results, cmp.AllowUnexported(budgetResult{})); diff != "" {
+				t.Errorf("results mismatch (-want +got):\n%s", diff)
+			}
+
+			var deferred []string
+			for _, c := range selection.deferred {
+				deferred = append(deferred, c.rec.Metric)
+			}
+			slices.Sort(deferred)
+			if diff := cmp.Diff(tt.deferred, deferred); diff != "" {
+				t.Errorf("deferred mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestBudgetUnknownSegments(t *testing.T) {
+	segments := []internal.Segment{{Identifier: "01HA", Name: "a"}, internal.DefaultSegment}
+	b := budgetConfig{Segments: []segmentBudget{
+		{Segment: "a", ReduceBy: 1},
+		{Segment: "default", ReduceBy: 1},
+		{ID: "01HA", ReduceBy: 1},
+		{Segment: "old name", ReduceBy: 1},
+		// The ID takes precedence over the name.
+		{Segment: "a", ID: "01HDELETED", ReduceBy: 1},
+	}}
+
+	want := []string{
+		`the budget of segment "old name" doesn't match any segment, so it doesn't apply`,
+		`the budget of segment with id "01HDELETED" doesn't match any segment, so it doesn't apply`,
+	}
+	if diff := cmp.Diff(want, b.unknownSegments(segments)); diff != "" {
+		t.Errorf("unknownSegments() mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v3"
+)
+
+const defaultConfigFile = "adaptive-metrics.yaml"
+
+// setting is an option that can be set in the config file and the environment. Commands use the resolved value as
+// the default of their flag, so the precedence is flag > env > config > default.
+type setting struct {
+	// key is the section and name of the setting in the config file.
+	key    string
+	env    string
+	def    string
+	secret bool
+	// validate checks the resolved value, if it isn't empty.
+	validate func(string) error
+}
+
+var (
+	settingAPIURL    = setting{key: "connection.api_url", env: "GRAFANA_AM_API_URL"}
+	settingAPIKey    = setting{key: "connection.api_key", env: "GRAFANA_AM_API_KEY", secret: true}
+	settingUserAgent = setting{key: "connection.user_agent", def: "gh-action-autoapply"}
+
+	settingWorkingDir    = setting{key: "segments.working_dir", env: "INPUT_WORKING-DIR", def: "./"}
+	settingFormat        = setting{key: "segments.format", env: "INPUT_FORMAT", validate: validateWith(parseRuleFileFormat)}
+	settingLayout        = setting{key: "segments.layout", env: "INPUT_LAYOUT", validate: validateWith(parseRuleFileLayout)}
+	settingDeleteOrphans = setting{key: "segments.delete_orphans", env: "INPUT_DELETE-ORPHANS", def: "false", validate: validateWith(strconv.ParseBool)}
+	settingWriteSegments = setting{key: "segments.write_segments", def: "false", validate: validateWith(strconv.ParseBool)}
+	settingManagedBy     = setting{key: "segments.managed_by", env: "INPUT_MANAGED-BY", def: "gh-action-autoapply"}
+
+	settingRiskFile            = setting{key: "policies.risk_file", env: "INPUT_RISK-FILE"}
+	settingMaxRisk             = setting{key: "policies.max_risk", env: "INPUT_MAX-RISK", def: "medium", validate: validateWith(parseRiskLevel)}
+	settingBudgetFile          = setting{key: "policies.budget_file", env: "INPUT_BUDGET-FILE"}
+	settingExemptionsFile      = setting{key: "policies.exemptions_file", env: "INPUT_EXEMPTIONS-FILE"}
+	settingFiltersFile         = setting{key: "policies.filters_file", env: "INPUT_FILTERS-FILE"}
+	settingPluginsFile         = setting{key: "policies.plugins_file", env: "INPUT_PLUGINS-FILE"}
+	settingProtectedLabelsFile = setting{key: "policies.protected_labels_file", env: "INPUT_PROTECTED-LABELS-FILE"}
+	settingOwnershipFile       = setting{key: "policies.ownership_file", env: "INPUT_OWNERSHIP-FILE"}
+	settingPricingFile         = setting{key: "policies.pricing_file", env: "INPUT_PRICING-FILE"}
+	settingCooldown            = setting{key: "policies.cooldown", env: "INPUT_COOLDOWN", validate: validateWith(model.ParseDuration)}
+	settingCooldownFile        = setting{key: "policies.cooldown_file", env: "INPUT_COOLDOWN-FILE", def: defaultCooldownFile}
+
+	settingDryRun         = setting{key: "output.dry_run", env: "INPUT_DRY-RUN", def: "false", validate: validateWith(strconv.ParseBool)}
+	settingDiffFile       = setting{key: "output.diff_file", env: "INPUT_DIFF-FILE"}
+	settingSeriesImpact   = setting{key: "output.series_impact", env: "INPUT_SERIES-IMPACT", def: "false", validate: validateWith(strconv.ParseBool)}
+	settingTeamReportFile = setting{key: "output.team_report_file", env: "INPUT_TEAM-REPORT-FILE"}
+	settingHistoryDir     = setting{key: "output.history_dir", env: "INPUT_HISTORY-DIR"}
+)
+
+// settings lists every setting in the order config print shows them.
+var settings = []setting{
+	settingAPIURL, settingAPIKey, settingUserAgent,
+	settingWorkingDir, settingFormat, settingLayout, settingDeleteOrphans, settingWriteSegments, settingManagedBy,
+	settingRiskFile, settingMaxRisk, settingBudgetFile, settingExemptionsFile, settingFiltersFile, settingPluginsFile,
+	settingProtectedLabelsFile, settingOwnershipFile, settingPricingFile, settingCooldown, settingCooldownFile,
+	settingDryRun, settingDiffFile, settingSeriesImpact, settingTeamReportFile, settingHistoryDir,
+}
+
+func validateWith[T any](parse func(string) (T, error)) func(string) error {
+	return func(s string) error {
+		_, err := parse(s)
+		return err
+	}
+}
+
+// config holds the settings of the config file.
+type config struct {
+	path   string
+	values map[string]string
+}
+
+// loadConfig reads the config file named by the -config flag in args, INPUT_CONFIG-FILE, or the default one if it
+// exists. It registers the -config flag, so that the flag set accepts it and lists it in the usage.
+func loadConfig(flags *flag.FlagSet, args []string) *config {
+	path, explicit := configPath(args)
+	flags.String("config", path, "The config file with the defaults of the settings. Flags and environment variables take precedence.")
+
+	c, err := readConfig(path)
+	if errors.Is(err, os.ErrNotExist) && !explicit {
+		c, err = &config{values: map[string]string{}}, nil
+	}
+	if err == nil {
+		err = c.validate()
+	}
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	return c
+}
+
+// configPath looks for the -config flag ahead of parsing, since the other flags take their defaults from the file.
+func configPath(args []string) (string, bool) {
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !strings.HasPrefix(arg, "-") || name != "config" {
+			continue
+		}
+		if hasValue {
+			return value, true
+		}
+		if i+1 < len(args) {
+			return args[i+1], true
+		}
+	}
+	if configFileEnvVar := os.Getenv("INPUT_CONFIG-FILE"); configFileEnvVar != "" {
+		return configFileEnvVar, true
+	}
+	return defaultConfigFile, false
+}
+
+func readConfig(path string) (*config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+
+	// Settings are strings like environment variables, so that they're parsed the same way wherever they come from.
+	var sections map[string]map[string]string
+	if err := yaml.Unmarshal(data, &sections); err != nil {
+		return nil, fmt.Errorf("failed to read config %s: %w", path, err)
+	}
+
+	c := &config{path: path, values: map[string]string{}}
+	for section, values := range sections {
+		for name, value := range values {
+			key := section + "." + name
+			if !isSetting(key) {
+				return nil, fmt.Errorf("unknown setting %s in %s", key, path)
+			}
+			c.values[key] = value
+		}
+	}
+	return c, nil
+}
+
+func isSetting(key string) bool {
+	for _, s := range settings {
+		if s.key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// validate checks the resolved values, so that a typo fails every command rather than only the ones that use it.
+func (c *config) validate() error {
+	var problems []string
+	for _, s := range settings {
+		value, source := c.resolve(s)
+		if value == "" || s.validate == nil {
+			continue
+		}
+		if err := s.validate(value); err != nil {
+			problems = append(problems, fmt.Sprintf("%s from %s: %v", s.key, source, err))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid settings: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// resolve returns the value of the setting from the environment, the config file or its default, in that order,
+// and where it came from.
+func (c *config) resolve(s setting) (string, string) {
+	if s.env != "" {
+		if value := os.Getenv(s.env); value != "" {
+			return value, "env " + s.env
+		}
+	}
+	if value, ok := c.values[s.key]; ok {
+		return value, "config " + c.path
+	}
+	return s.def, "default"
+}
+
+func (c *config) get(s setting) string {
+	value, _ := c.resolve(s)
+	return value
+}
+
+func (c *config) getBool(s setting) bool {
+	value, source := c.resolve(s)
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Fatalf("error parsing %s from %s: %s", s.key, source, err)
+	}
+	return b
+}
+
+// mustGet returns the value of a required setting.
+func (c *config) mustGet(s setting) string {
+	value := c.get(s)
+	if value == "" {
+		log.Fatalf("missing required setting, set %s or %s in the config file", s.env, s.key)
+	}
+	return value
+}
+
+func configCommand(args []string) {
+	if len(args) < 1 {
+		log.Fatalf("missing config command, available commands: print")
+	}
+
+	switch args[0] {
+	case "print":
+		configPrint(args[1:])
+	default:
+		log.Fatalf("unknown config command %s, available commands: print", args[0])
+	}
+}
+
+// configPrint prints the resolved settings as a config file, with where each value came from. Secrets are redacted.
+func configPrint(args []string) {
+	flags := flag.NewFlagSet("config print", flag.ExitOnError)
+	cfg := loadConfig(flags, args)
+
+	err := flags.Parse(args)
+	if err != nil {
+		log.Fatalf("failed to parse flags: %v", err)
+	}
+
+	doc := &yaml.Node{Kind: yaml.MappingNode}
+	sections := map[string]*yaml.Node{}
+	for _, s := range settings {
+		section, name, _ := strings.Cut(s.key, ".")
+		if sections[section] == nil {
+			sections[section] = &yaml.Node{Kind: yaml.MappingNode}
+			doc.Content = append(doc.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: section}, sections[section])
+		}
+
+		value, source := cfg.resolve(s)
+		if s.secret && value != "" {
+			value = "<redacted>"
+		}
+		sections[section].Content = append(sections[section].Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Value: name},
+			&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value, LineComment: source},
+		)
+	}
+
+	enc := yaml.NewEncoder(os.Stdout)
+	enc.SetIndent(2)
+	if err := enc.Encode(doc); err != nil {
+		log.Fatalf("failed to print config: %v", err)
+	}
+	if err := enc.Close(); err != nil {
+		log.Fatalf("failed to print config: %v", err)
+	}
+}
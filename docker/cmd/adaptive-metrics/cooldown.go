@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/grafana/adaptive-metrics-autoapply/docker/internal"
+)
+
+const defaultCooldownFile = "cooldown.json"
+
+// cooldownState remembers when rules were removed, so that pull doesn't add them back right away.
+type cooldownState struct {
+	Segments []segmentCooldown `json:"segments"`
+}
+
+type segmentCooldown struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Rules are the rules the segment had after the last pull, to notice rules deleted by hand since.
+	Rules []string `json:"rules"`
+	// Removed maps the removed rules to when they were removed.
+	Removed map[string]time.Time `json:"removed,omitempty"`
+}
+
+// readCooldownState reads the state in file. A missing file means no rules were removed yet.
+func readCooldownState(file string) (*cooldownState, error) {
+	state, err := readJSONFile[cooldownState](file)
+	if errors.Is(err, os.ErrNotExist) {
+		return &cooldownState{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cooldown state %s: %w", file, err)
+	}
+	return &state, nil
+}
+
+// segment returns the state of the segment, adding it if it has none yet.
+func (s *cooldownState) segment(segment internal.Segment) *segmentCooldown {
+	i := slices.IndexFunc(s.Segments, func(c segmentCooldown) bool { return c.ID == segment.Identifier })
+	if i < 0 {
+		s.Segments = append(s.Segments, segmentCooldown{ID: segment.Identifier})
+		i = len(s.Segments) - 1
+	}
+	// Follow renames, the name is only there to make the file readable.
+	s.Segments[i].Name = segment.Name
+	return &s.Segments[i]
+}
+
+// prune drops the state of segments that no longer exist.
+func (s *cooldownState) prune(segments []internal.Segment) {
+	s.Segments = slices.DeleteFunc(s.Segments, func(c segmentCooldown) bool {
+		return !slices.ContainsFunc(segments, func(segment internal.Segment) bool { return segment.Identifier == c.ID })
+	})
+}
+
+func (s *cooldownState) marshal() ([]byte, error) {
+	return json.MarshalIndent(s, "", "  ")
+}
+
+// recordDeletions records the rules that were in the segment after the last pull, but have been deleted from its
+// rule files since.
+func (c *segmentCooldown) recordDeletions(now time.Time, oldRules []internal.Recommendation) {
+	// The first pull with a cooldown has nothing to compare against.
+	if c.Rules == nil {
+		return
+	}
+
+	current := ruleKeys(oldRules)
+	for _, key := range c.Rules {
+		if !current[key] {
+			c.removed(now, key)
+		}
+	}
+}
+
+// suppressReAdds drops the recommendations that add back a rule removed less than cooldown ago.
+func (c *segmentCooldown) suppressReAdds(now time.Time, cooldown time.Duration, segment internal.Segment, recs, oldRules []internal.Recommendation) ([]internal.Recommendation, []suppressedReAdd) {
+	current := ruleKeys(oldRules)
+	var kept []internal.Recommendation
+	var suppressed []suppressedReAdd
+	for _, rec := range recs {
+		removedAt, ok := c.Removed[ruleKey(rec)]
+		if !ok || current[ruleKey(rec)] || rec.RecommendedAction == "remove" || !now.Before(removedAt.Add(cooldown)) {
+			kept = append(kept, rec)
+			continue
+		}
+		suppressed = append(suppressed, suppressedReAdd{segment: segment.Name, rec: rec, removedAt: removedAt, until: removedAt.Add(cooldown)})
+	}
+	return kept, suppressed
+}
+
+// update records the rules the pull removes, and forgets the removals whose cooldown has ended.
+func (c *segmentCooldown) update(now time.Time, cooldown time.Duration, oldRules, newRules []internal.Recommendation) {
+	kept := ruleKeys(newRules)
+	for key := range ruleKeys(oldRules) {
+		if !kept[key] {
+			c.removed(now, key)
+		}
+	}
+
+	for key, removedAt := range c.Removed {
+		if kept[key] || !now.Before(removedAt.Add(cooldown)) {
+			delete(c.Removed, key)
+		}
+	}
+
+	c.Rules = make([]string, 0, len(kept))
+	for key := range kept {
+		c.Rules = append(c.Rules, key)
+	}
+	sort.Strings(c.Rules)
+}
+
+func (c *segmentCooldown) removed(now time.Time, key string) {
+	if c.Removed == nil {
+		c.Removed = map[string]time.Time{}
+	}
+	c.Removed[key] = now
+}
+
+func ruleKeys(rules []internal.Recommendation) map[string]bool {
+	keys := make(map[string]bool, len(rules))
+	for _, rule := range rules {
+		keys[ruleKey(rule)] = true
+	}
+	return keys
+}
+
+type suppressedReAdd struct {
+	segment   string
+	rec       internal.Recommendation
+	removedAt time.Time
+	until     time.Time
+}
+
+func writeSuppressedReAdds(output io.Writer, suppressed []suppressedReAdd) {
+	if len(suppressed) == 0 {
+		return
+	}
+
+	fmt.Fprintln(output, "## Suppressed re-adds")
+	fmt.Fprintln(output, "These rules were removed recently, so they aren't added back until their cooldown ends:")
+	fmt.Fprintln(output, "| Segment | Metric | Action | Series Change | Removed | Cooldown Ends |")
+	fmt.Fprintln(output, "|---------|--------|--------|---------------|---------|---------------|")
+	for _, s := range suppressed {
+		fmt.Fprintf(output, "| %s | %s | %s | %d | %s | %s |\n", s.segment, s.rec.Metric, s.rec.RecommendedAction, s.rec.RecommendedSeriesCount-s.rec.CurrentSeriesCount, s.removedAt.Format(time.DateOnly), s.until.Format(time.DateOnly))
+	}
+}
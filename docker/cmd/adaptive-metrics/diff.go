@@ -1,9 +1,13 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
+	"os"
 	"reflect"
+	"slices"
+	"strconv"
 	"strings"
 
 	"github.com/google/go-cmp/cmp"
@@ -11,65 +15,225 @@ import (
 	"github.com/grafana/adaptive-metrics-autoapply/docker/internal"
 )
 
-func writeDiff(output io.Writer, segment internal.Segment, oldRec, newRec []internal.Recommendation) int {
-	type stateChange struct {
-		old, new internal.Recommendation
+type changeType string
+
+const (
+	changeAdd    changeType = "add"
+	changeRemove changeType = "remove"
+	changeModify changeType = "modify"
+)
+
+// ruleChange describes how a single rule changes. It's the model both the markdown diff and the JSON diff file are
+// built from.
+type ruleChange struct {
+	Segment   string        `json:"segment"`
+	Metric    string        `json:"metric"`
+	MatchType string        `json:"match_type"`
+	Type      changeType    `json:"change"`
+	Fields    []fieldChange `json:"fields"`
+	Impact    *seriesImpact `json:"impact,omitempty"`
+}
+
+func (c ruleChange) key() string {
+	return ruleKey(internal.Recommendation{RuleData: internal.RuleData{Metric: c.Metric, MatchType: c.MatchType}})
+}
+
+// seriesImpact is what the recommendations know about the metric of a changed rule. The expected series count is
+// only known if the rule ends up as recommended, or is removed.
+type seriesImpact struct {
+	CurrentSeries      int  `json:"current_series"`
+	ExpectedSeries     *int `json:"expected_series,omitempty"`
+	UsagesInRules      int  `json:"usages_in_rules"`
+	UsagesInQueries    int  `json:"usages_in_queries"`
+	UsagesInDashboards int  `json:"usages_in_dashboards"`
+}
+
+// seriesChange returns the expected change in series, or false if it's unknown.
+func (i *seriesImpact) seriesChange() (int, bool) {
+	if i == nil || i.ExpectedSeries == nil {
+		return 0, false
 	}
+	return *i.ExpectedSeries - i.CurrentSeries, true
+}
 
-	changesByName := map[string]stateChange{}
-	for _, rule := range oldRec {
-		changesByName[rule.Metric] = stateChange{old: rule}
+// fieldChange holds the old and new value of a rule field, using the names of the rule files. A missing value means
+// the field is unset. For fields whose order doesn't matter, it also holds the added and removed values.
+type fieldChange struct {
+	Field   string   `json:"field"`
+	Old     any      `json:"old,omitempty"`
+	New     any      `json:"new,omitempty"`
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+}
+
+// orderChange lists the prefix and suffix rules of a segment before and after a change to their relative order.
+// Unlike exact rules, the first one that matches a metric wins, so their order is significant.
+type orderChange struct {
+	Segment string   `json:"segment"`
+	Old     []string `json:"old"`
+	New     []string `json:"new"`
+}
+
+type diffReport struct {
+	Changes      []ruleChange  `json:"changes"`
+	OrderChanges []orderChange `json:"order_changes"`
+}
+
+// segmentDiff holds all changes to the rules of a segment.
+type segmentDiff struct {
+	segment internal.Segment
+	changes []ruleChange
+	order   *orderChange
+
+	// currentSeries is the number of series of the segment, if the recommendations were fetched.
+	currentSeries int
+	// decisions are what plugins decided on the rules before they were diffed.
+	decisions []pluginDecision
+}
+
+func (d segmentDiff) count() int {
+	if d.order != nil {
+		return len(d.changes) + 1
+	}
+	return len(d.changes)
+}
+
+// seriesChange returns the net series change of the changes whose impact is known.
+func (d segmentDiff) seriesChange() (int, bool) {
+	total, known := 0, false
+	for _, change := range d.changes {
+		if c, ok := change.Impact.seriesChange(); ok {
+			total += c
+			known = true
+		}
 	}
+	return total, known
+}
 
+// addSeriesImpact joins the verbose recommendations of the segment to its changed rules.
+func (d segmentDiff) addSeriesImpact(recs, newRec []internal.Recommendation) {
+	recsByKey := map[string]internal.Recommendation{}
+	for _, rec := range recs {
+		recsByKey[ruleKey(rec)] = rec
+	}
+	newByKey := map[string]internal.Recommendation{}
 	for _, rule := range newRec {
-		change, ok := changesByName[rule.Metric]
+		newByKey[ruleKey(rule)] = rule
+	}
+
+	for i, change := range d.changes {
+		key := change.key()
+		rec, ok := recsByKey[key]
 		if !ok {
-			changesByName[rule.Metric] = stateChange{new: rule}
 			continue
 		}
 
-		change.new = rule
-		changesByName[rule.Metric] = change
+		impact := &seriesImpact{
+			CurrentSeries:      rec.CurrentSeriesCount,
+			UsagesInRules:      rec.UsagesInRules,
+			UsagesInQueries:    rec.UsagesInQueries,
+			UsagesInDashboards: rec.UsagesInDashboards,
+		}
+		switch {
+		case change.Type == changeRemove:
+			impact.ExpectedSeries = &rec.RawSeriesCount
+		case isRecommendedRule(rec, newByKey[key]):
+			impact.ExpectedSeries = &rec.RecommendedSeriesCount
+		}
+		d.changes[i].Impact = impact
+	}
+}
+
+func isRecommendedRule(rec, rule internal.Recommendation) bool {
+	if rec.RecommendedAction == "remove" {
+		return false
 	}
+	a, b := rec.RuleData, rule.RuleData
+	a.ManagedBy, b.ManagedBy = "", ""
+	_, changed := diffRule(internal.Segment{}, a, b)
+	return !changed
+}
 
-	var changes int
-	var segmentOutput = new(strings.Builder)
-	for _, change := range changesByName {
-		if generateDiff(segmentOutput, change.old, change.new) {
-			changes++
+// setFields are the rule fields that are compared as sets, since the order of their values has no meaning.
+var setFields = map[string]bool{
+	"KeepLabels":   true,
+	"DropLabels":   true,
+	"Aggregations": true,
+}
+
+func diffSegment(segment internal.Segment, oldRec, newRec []internal.Recommendation) segmentDiff {
+	return segmentDiff{
+		segment: segment,
+		changes: diffRules(segment, oldRec, newRec),
+		order:   diffRuleOrder(segment, oldRec, newRec),
+	}
+}
+
+// diffRules returns the changes to the rules of a segment, keyed by metric and match type. They're sorted like pull
+// sorts rule files: exact match rules by metric first, then other rules in their new order followed by removed ones.
+func diffRules(segment internal.Segment, oldRec, newRec []internal.Recommendation) []ruleChange {
+	type stateChange struct {
+		old, new internal.Recommendation
+	}
+
+	var order []internal.Recommendation
+	changesByKey := map[string]stateChange{}
+	for _, rule := range newRec {
+		if _, ok := changesByKey[ruleKey(rule)]; !ok {
+			order = append(order, rule)
+		}
+		changesByKey[ruleKey(rule)] = stateChange{new: rule}
+	}
+
+	for _, rule := range oldRec {
+		change, ok := changesByKey[ruleKey(rule)]
+		if !ok {
+			order = append(order, rule)
 		}
+		change.old = rule
+		changesByKey[ruleKey(rule)] = change
 	}
 
-	if changes > 0 {
-		diffOutput := segmentOutput.String()
-		diffOutput = strings.Trim(diffOutput, "\n")
-		fmt.Fprintf(output, "#### Segment %q:\n```diff\n%s\n```\n", segment.Name, diffOutput)
+	slices.SortStableFunc(order, compareRuleOrder)
+
+	var changes []ruleChange
+	for _, rule := range order {
+		change := changesByKey[ruleKey(rule)]
+		if c, ok := diffRule(segment, change.old.RuleData, change.new.RuleData); ok {
+			changes = append(changes, c)
+		}
 	}
 
 	return changes
 }
 
-func generateDiff(output *strings.Builder, a, b internal.Recommendation) bool {
-
+func diffRule(segment internal.Segment, a, b internal.RuleData) (ruleChange, bool) {
 	aVal := reflect.ValueOf(a)
 	bVal := reflect.ValueOf(b)
 	rType := aVal.Type()
 
-	metricName := a.Metric
-	diffType := "~"
+	change := ruleChange{
+		Segment:   segment.Name,
+		Metric:    a.Metric,
+		MatchType: a.MatchType,
+		Type:      changeModify,
+	}
 	if aVal.IsZero() {
-		diffType = "+"
-		metricName = b.Metric
+		change.Type = changeAdd
+		change.Metric = b.Metric
+		change.MatchType = b.MatchType
 	}
 	if bVal.IsZero() {
-		diffType = "-"
-		metricName = a.Metric
+		change.Type = changeRemove
+	}
+	if change.MatchType == "" {
+		change.MatchType = "exact"
 	}
 
-	metricOutput := new(strings.Builder)
 	for i := 0; i < aVal.NumField(); i++ {
 		fieldType := rType.Field(i)
-		if fieldType.Name == "Metric" {
+		// Rules are matched by metric and match type, so these never change.
+		if fieldType.Name == "Metric" || fieldType.Name == "MatchType" {
 			continue
 		}
 		aField := aVal.Field(i)
@@ -80,28 +244,228 @@ func generateDiff(output *strings.Builder, a, b internal.Recommendation) bool {
 			continue
 		}
 
-		if aField.IsZero() {
-			fmt.Fprintf(metricOutput, "+\t%s=%q\n", name, bField.Interface())
+		if setFields[fieldType.Name] {
+			field := fieldChange{
+				Field:   name,
+				Added:   setDifference(bField.Interface().([]string), aField.Interface().([]string)),
+				Removed: setDifference(aField.Interface().([]string), bField.Interface().([]string)),
+			}
+			if len(field.Added) == 0 && len(field.Removed) == 0 {
+				continue
+			}
+			if !aField.IsZero() {
+				field.Old = aField.Interface()
+			}
+			if !bField.IsZero() {
+				field.New = bField.Interface()
+			}
+			change.Fields = append(change.Fields, field)
+			continue
+		}
+
+		field := fieldChange{Field: name}
+		if !aField.IsZero() {
+			field.Old = aField.Interface()
+		}
+		if !bField.IsZero() {
+			field.New = bField.Interface()
+		}
+		if field.Old != nil && field.New != nil && cmp.Equal(field.Old, field.New) {
 			continue
 		}
 
-		if bField.IsZero() {
-			fmt.Fprintf(metricOutput, "-\t%s=%q\n", name, aField.Interface())
+		change.Fields = append(change.Fields, field)
+	}
+
+	return change, len(change.Fields) > 0
+}
+
+// setDifference returns the sorted values of a that aren't in b.
+func setDifference(a, b []string) []string {
+	var diff []string
+	for _, v := range a {
+		if !slices.Contains(b, v) && !slices.Contains(diff, v) {
+			diff = append(diff, v)
+		}
+	}
+	slices.Sort(diff)
+	return diff
+}
+
+// diffRuleOrder reports a change to the relative order of the prefix and suffix rules that exist both before and
+// after the change. Added and removed rules are reported by diffRules instead.
+func diffRuleOrder(segment internal.Segment, oldRec, newRec []internal.Recommendation) *orderChange {
+	oldOrder := nonExactRuleOrder(oldRec)
+	newOrder := nonExactRuleOrder(newRec)
+
+	var oldCommon, newCommon []string
+	for _, key := range oldOrder {
+		if slices.Contains(newOrder, key) {
+			oldCommon = append(oldCommon, key)
+		}
+	}
+	for _, key := range newOrder {
+		if slices.Contains(oldOrder, key) {
+			newCommon = append(newCommon, key)
+		}
+	}
+	if slices.Equal(oldCommon, newCommon) {
+		return nil
+	}
+
+	return &orderChange{
+		Segment: segment.Name,
+		Old:     oldOrder,
+		New:     newOrder,
+	}
+}
+
+func nonExactRuleOrder(recs []internal.Recommendation) []string {
+	var order []string
+	for _, rec := range recs {
+		if !isExactMatch(rec) {
+			order = append(order, matchTypeOf(rec)+" "+rec.Metric)
+		}
+	}
+	return order
+}
+
+func writeDiff(output io.Writer, diff segmentDiff) {
+	if diff.count() == 0 {
+		return
+	}
+
+	var segmentOutput = new(strings.Builder)
+	for _, change := range diff.changes {
+		writeRuleChange(segmentOutput, change)
+	}
+	if diff.order != nil {
+		writeOrderChange(segmentOutput, *diff.order)
+	}
+
+	diffOutput := segmentOutput.String()
+	diffOutput = strings.Trim(diffOutput, "\n")
+	fmt.Fprintf(output, "#### Segment %q:\n```diff\n%s\n```\n", diff.segment.Name, diffOutput)
+	if change, ok := diff.seriesChange(); ok {
+		fmt.Fprintf(output, "Net series change: %d\n\n", change)
+	}
+}
+
+func writeRuleChange(output *strings.Builder, change ruleChange) {
+	diffType := "~"
+	switch change.Type {
+	case changeAdd:
+		diffType = "+"
+	case changeRemove:
+		diffType = "-"
+	}
+
+	if change.MatchType == "exact" {
+		fmt.Fprintf(output, "%s%s\n", diffType, change.Metric)
+	} else {
+		fmt.Fprintf(output, "%s%s (%s)\n", diffType, change.Metric, change.MatchType)
+	}
+	if impact := change.Impact; impact != nil {
+		series := strconv.Itoa(impact.CurrentSeries)
+		if c, ok := impact.seriesChange(); ok {
+			series = fmt.Sprintf("%d -> %d (%+d)", impact.CurrentSeries, *impact.ExpectedSeries, c)
+		}
+		fmt.Fprintf(output, " \tseries: %s, used in %d rules, %d queries, %d dashboards\n", series, impact.UsagesInRules, impact.UsagesInQueries, impact.UsagesInDashboards)
+	}
+	for _, field := range change.Fields {
+		if field.Added != nil || field.Removed != nil {
+			for _, v := range field.Removed {
+				fmt.Fprintf(output, "-\t%s: %s\n", field.Field, v)
+			}
+			for _, v := range field.Added {
+				fmt.Fprintf(output, "+\t%s: %s\n", field.Field, v)
+			}
 			continue
 		}
+		if field.Old != nil {
+			fmt.Fprintf(output, "-\t%s=%s\n", field.Field, formatDiffValue(field.Old))
+		}
+		if field.New != nil {
+			fmt.Fprintf(output, "+\t%s=%s\n", field.Field, formatDiffValue(field.New))
+		}
+	}
+	output.WriteString("\n")
+}
+
+func writeOrderChange(output *strings.Builder, change orderChange) {
+	output.WriteString("~order of prefix and suffix rules\n")
+	for _, rule := range change.Old {
+		fmt.Fprintf(output, "-\t%s\n", rule)
+	}
+	for _, rule := range change.New {
+		fmt.Fprintf(output, "+\t%s\n", rule)
+	}
+	output.WriteString("\n")
+}
+
+// writeBiggestImpacts renders a table of the changes with the largest known series change across all segments.
+func writeBiggestImpacts(output io.Writer, diffs []segmentDiff, limit int) {
+	var changes []ruleChange
+	for _, diff := range diffs {
+		for _, change := range diff.changes {
+			if _, ok := change.Impact.seriesChange(); ok {
+				changes = append(changes, change)
+			}
+		}
+	}
+	if len(changes) == 0 {
+		return
+	}
+
+	slices.SortStableFunc(changes, func(a, b ruleChange) int {
+		ac, _ := a.Impact.seriesChange()
+		bc, _ := b.Impact.seriesChange()
+		return abs(bc) - abs(ac)
+	})
+	if len(changes) > limit {
+		changes = changes[:limit]
+	}
+
+	fmt.Fprintln(output, "#### Biggest impacts")
+	fmt.Fprintln(output, "| Segment | Metric | Change | Current Series | Expected Series | Series Change |")
+	fmt.Fprintln(output, "|---------|--------|--------|----------------|-----------------|---------------|")
+	for _, c := range changes {
+		seriesChange, _ := c.Impact.seriesChange()
+		fmt.Fprintf(output, "| %s | %s | %s | %d | %d | %d |\n", c.Segment, c.Metric, c.Type, c.Impact.CurrentSeries, *c.Impact.ExpectedSeries, seriesChange)
+	}
+}
+
+func abs(i int) int {
+	if i < 0 {
+		return -i
+	}
+	return i
+}
 
-		d := cmp.Diff(aField.Interface(), bField.Interface())
-		if d != "" {
-			fmt.Fprintf(metricOutput, "~\t%s\n", name)
-			fmt.Fprintln(metricOutput, d)
+func formatDiffValue(v any) string {
+	out, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	return string(out)
+}
+
+func writeDiffFile(path string, diffs []segmentDiff) error {
+	report := diffReport{
+		Changes:      []ruleChange{},
+		OrderChanges: []orderChange{},
+	}
+	for _, diff := range diffs {
+		report.Changes = append(report.Changes, diff.changes...)
+		if diff.order != nil {
+			report.OrderChanges = append(report.OrderChanges, *diff.order)
 		}
 	}
 
-	if metricOutput.Len() > 0 {
-		fmt.Fprintf(output, "%s%s\n%s", diffType, metricName, metricOutput.String())
-		output.WriteString("\n")
-		return true
+	out, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
 	}
 
-	return false
+	return os.WriteFile(path, out, 0644)
 }
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/grafana/adaptive-metrics-autoapply/docker/internal"
+)
+
+type checkStatus string
+
+const (
+	checkPass checkStatus = "PASS"
+	checkFail checkStatus = "FAIL"
+	checkSkip checkStatus = "SKIP"
+)
+
+// doctorCheck is the outcome of one check, with what to do about it if it failed.
+type doctorCheck struct {
+	name        string
+	status      checkStatus
+	detail      string
+	remediation string
+}
+
+// doctor checks the setup: the API credentials and their scopes, the rule files, and the GitHub Actions environment.
+func doctor(args []string) {
+	flags := flag.NewFlagSet("doctor", flag.ExitOnError)
+	cfg := loadConfig(flags, args)
+	workingDir := flags.String("working-dir", cfg.get(settingWorkingDir), "The path to the working directory.")
+	userAgent := flags.String("user-agent", cfg.get(settingUserAgent), "The user-agent to use when making requests against the API.")
+
+	err := flags.Parse(args)
+	if err != nil {
+		log.Fatalf("failed to parse flags: %v", err)
+	}
+
+	var checks []doctorCheck
+	urlCheck := checkAPIURL(cfg.get(settingAPIURL))
+	keyCheck := checkAPIKey(cfg.get(settingAPIKey))
+	checks = append(checks, urlCheck, keyCheck)
+
+	// Without the segments, rule files can't be told apart from orphans.
+	var segments []internal.Segment
+	if urlCheck.status == checkPass && keyCheck.status == checkPass {
+		c := newClient(cfg, *userAgent)
+
+		var readCheck doctorCheck
+		segments, readCheck = checkReadAccess(c)
+		checks = append(checks, readCheck, checkWriteAccess(c))
+	} else {
+		checks = append(checks,
+			doctorCheck{name: "read access", status: checkSkip, detail: "the API URL or key is invalid"},
+			doctorCheck{name: "write access", status: checkSkip, detail: "the API URL or key is invalid"},
+		)
+	}
+
+	checks = append(checks, checkRuleFiles(*workingDir, segments)...)
+	ghaCheck := checkGithubActionsFiles()
+	checks = append(checks, ghaCheck)
+
+	failed := 0
+	for _, check := range checks {
+		fmt.Printf("%s  %s: %s\n", check.status, check.name, check.detail)
+		if check.status == checkFail {
+			failed++
+			if check.remediation != "" {
+				fmt.Printf("      %s\n", check.remediation)
+			}
+		}
+	}
+
+	if ghaCheck.status == checkPass {
+		gha, err := newGithubActionWorkflowCommands()
+		if err != nil {
+			log.Fatalf("failed to create GitHub Actions commands: %v", err)
+		}
+		defer gha.close()
+
+		output := new(strings.Builder)
+		writeDoctorChecks(output, checks)
+		err = gha.writeStepSummary(output.String())
+		if err != nil {
+			log.Fatalf("failed to write step summary: %v", err)
+		}
+	}
+
+	if failed > 0 {
+		log.Fatalf("%d of %d checks failed", failed, len(checks))
+	}
+}
+
+func checkAPIURL(apiURL string) doctorCheck {
+	check := doctorCheck{name: "GRAFANA_AM_API_URL"}
+	remediation := "Set it to the URL of your Grafana Cloud Prometheus stack, without any path, for example https://prometheus-prod-01-eu-west-0.grafana.net."
+
+	u, err := url.Parse(apiURL)
+	switch {
+	case apiURL == "":
+		check.status, check.detail = checkFail, "not set"
+	case err != nil:
+		check.status, check.detail = checkFail, fmt.Sprintf("not a valid URL: %v", err)
+	case u.Scheme != "https" && u.Scheme != "http":
+		check.status, check.detail = checkFail, fmt.Sprintf("%q has no http or https scheme", apiURL)
+	case u.Host == "":
+		check.status, check.detail = checkFail, fmt.Sprintf("%q has no host", apiURL)
+	case u.Path != "" || u.RawQuery != "" || u.Fragment != "":
+		check.status, check.detail = checkFail, fmt.Sprintf("%q must only be the host, found %q after it", apiURL, strings.TrimPrefix(apiURL, u.Scheme+"://"+u.Host))
+		remediation = fmt.Sprintf("Set it to %s://%s, removing everything after the host.", u.Scheme, u.Host)
+	default:
+		check.status, check.detail = checkPass, u.Host
+	}
+
+	if check.status == checkFail {
+		check.remediation = remediation
+	}
+	return check
+}
+
+func checkAPIKey(apiKey string) doctorCheck {
+	check := doctorCheck{name: "GRAFANA_AM_API_KEY"}
+	id, token, found := strings.Cut(apiKey, ":")
+	switch {
+	case apiKey == "":
+		check.status, check.detail = checkFail, "not set"
+	case !found || token == "":
+		check.status, check.detail = checkFail, "not in the <instance-id>:<token> format"
+	case id == "" || strings.Trim(id, "0123456789") != "":
+		check.status, check.detail = checkFail, fmt.Sprintf("the instance ID %q isn't numeric", id)
+	default:
+		check.status, check.detail = checkPass, fmt.Sprintf("instance %s", id)
+	}
+
+	if check.status == checkFail {
+		check.remediation = "Set it to <instance-id>:<token>, with the numeric instance ID from the details page of your Grafana Cloud Prometheus stack and a Grafana Cloud access policy token."
+	}
+	return check
+}
+
+func checkReadAccess(c *internal.Client) ([]internal.Segment, doctorCheck) {
+	check := doctorCheck{name: "read access"}
+	segments, err := c.FetchSegments()
+	if err != nil {
+		check.status, check.detail, check.remediation = checkFail, fmt.Sprintf("failed to fetch segments: %v", err), apiRemediation(err, "metrics:read")
+		return nil, check
+	}
+
+	check.status, check.detail = checkPass, fmt.Sprintf("fetched %d segments", len(segments))
+	return append(segments, internal.DefaultSegment), check
+}
+
+// checkWriteAccess validates an empty rule set, which needs the same scope as applying rules without changing any.
+func checkWriteAccess(c *internal.Client) doctorCheck {
+	check := doctorCheck{name: "write access"}
+	err := c.ValidateRules([]internal.Recommendation{})
+	if err != nil {
+		check.status, check.detail, check.remediation = checkFail, fmt.Sprintf("failed to check rules: %v", err), apiRemediation(err, "metrics:write")
+		return check
+	}
+
+	check.status, check.detail = checkPass, "checked an empty rule set"
+	return check
+}
+
+// apiRemediation explains how to fix a failed API request that needs scope.
+func apiRemediation(err error, scope string) string {
+	var statusErr *internal.StatusError
+	if !errors.As(err, &statusErr) {
+		return "Check that GRAFANA_AM_API_URL points to your Grafana Cloud Prometheus stack and that it can be reached from here."
+	}
+
+	switch statusErr.StatusCode {
+	case http.StatusUnauthorized:
+		return "The key was rejected. Check that the instance ID matches the stack and that the token is valid and hasn't expired."
+	case http.StatusForbidden:
+		return fmt.Sprintf("Add the %s scope for this stack to the access policy of the token.", scope)
+	case http.StatusNotFound:
+		return "Check that GRAFANA_AM_API_URL is the URL of your Grafana Cloud Prometheus stack, and not of Grafana or another service."
+	default:
+		return "Try again later, the API may be unavailable."
+	}
+}
+
+// checkRuleFiles checks that the rule files of the segments parse, and that there are no rule files for other segments.
+func checkRuleFiles(dir string, segments []internal.Segment) []doctorCheck {
+	parse := doctorCheck{name: "rule files"}
+	orphaned := doctorCheck{name: "orphaned rule files"}
+
+	manifest, err := readSegmentManifest(dir)
+	if err != nil {
+		parse.status, parse.detail, parse.remediation = checkFail, err.Error(), fmt.Sprintf("Fix or delete %s, pull recreates it.", manifestFilename)
+		orphaned.status, orphaned.detail = checkSkip, "the manifest is invalid"
+		return []doctorCheck{parse, orphaned}
+	}
+	if segments == nil {
+		parse.status, parse.detail = checkSkip, "the segments couldn't be fetched"
+		orphaned.status, orphaned.detail = checkSkip, "the segments couldn't be fetched"
+		return []doctorCheck{parse, orphaned}
+	}
+
+	var problems []string
+	files := 0
+	for _, segment := range segments {
+		segmentFiles, err := manifest.segmentFiles(dir, segment)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err == nil {
+			_, err = mergeRuleFiles(segmentFiles)
+		}
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("segment %q: %v", segment.Name, err))
+		}
+		files += len(segmentFiles)
+	}
+	if len(problems) > 0 {
+		parse.status, parse.detail, parse.remediation = checkFail, strings.Join(problems, "; "), "Fix the rule files, or delete them and pull again."
+	} else {
+		parse.status, parse.detail = checkPass, fmt.Sprintf("%d rule files parse", files)
+	}
+
+	// Only the manifest entries of existing segments own files. Without a manifest, segments own the files named
+	// after them.
+	current := &segmentManifest{}
+	for _, segment := range segments {
+		if entry, ok := manifest.lookup(segment); ok {
+			current.Segments = append(current.Segments, entry)
+		}
+	}
+	owned := func(name string) bool {
+		for _, segment := range segments {
+			if entry, ok := current.lookup(segment); ok && entry.File == name {
+				return true
+			}
+			if manifest == nil && strings.TrimSuffix(name, filepath.Ext(name)) == segmentFileStem(segment) {
+				return true
+			}
+		}
+		return false
+	}
+	orphans, err := findOrphanedRuleFiles(dir, current, owned)
+	switch {
+	case err != nil:
+		orphaned.status, orphaned.detail = checkFail, fmt.Sprintf("failed to look for orphaned rule files: %v", err)
+	case len(orphans) > 0:
+		orphaned.status, orphaned.detail = checkFail, fmt.Sprintf("no segment owns %s", strings.Join(orphans, ", "))
+		orphaned.remediation = "Delete them, or pull with delete-orphans enabled. Apply ignores them."
+	default:
+		orphaned.status, orphaned.detail = checkPass, "every rule file belongs to a segment"
+	}
+	return []doctorCheck{parse, orphaned}
+}
+
+// checkGithubActionsFiles checks that the files for step outputs and the step summary can be written to. It doesn't
+// use newGithubActionWorkflowCommands, since that would truncate the summary.
+func checkGithubActionsFiles() doctorCheck {
+	check := doctorCheck{name: "GitHub Actions files"}
+	if os.Getenv("GITHUB_ACTIONS") != "true" {
+		check.status, check.detail = checkSkip, "not running in GitHub Actions"
+		return check
+	}
+
+	var problems []string
+	for _, env := range []string{"GITHUB_OUTPUT", "GITHUB_STEP_SUMMARY"} {
+		path := os.Getenv(env)
+		if path == "" {
+			problems = append(problems, env+" is not set")
+			continue
+		}
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s isn't writable: %v", env, err))
+			continue
+		}
+		_ = f.Close()
+	}
+
+	if len(problems) > 0 {
+		check.status, check.detail = checkFail, strings.Join(problems, "; ")
+		check.remediation = "Run the action in a job step, where GitHub sets these files up, and don't override the variables."
+		return check
+	}
+	check.status, check.detail = checkPass, "GITHUB_OUTPUT and GITHUB_STEP_SUMMARY are writable"
+	return check
+}
+
+func writeDoctorChecks(output io.Writer, checks []doctorCheck) {
+	fmt.Fprintln(output, "## Doctor")
+	fmt.Fprintln(output, "| Check | Status | Details | Remediation |")
+	fmt.Fprintln(output, "|-------|--------|---------|-------------|")
+	for _, c := range checks {
+		fmt.Fprintf(output, "| %s | %s | %s | %s |\n", c.name, c.status, strings.ReplaceAll(c.detail, "|", "\\|"), c.remediation)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/grafana/adaptive-metrics-autoapply/docker/internal"
+)
+
+const defaultExemptionWarnDays = 14
+
+// exemptionsConfig lists metrics whose rules pull must not change until the exemption expires.
+type exemptionsConfig struct {
+	// WarnDays is how many days before expiry to start warning.
+	WarnDays   int         `json:"warn_days,omitempty" yaml:"warn_days,omitempty"`
+	Exemptions []exemption `json:"exemptions" yaml:"exemptions"`
+}
+
+type exemption struct {
+	Metric string `json:"metric" yaml:"metric"`
+	// MatchType defaults to exact. Segment limits the exemption to one segment, it applies to all by default.
+	MatchType string `json:"match_type,omitempty" yaml:"match_type,omitempty"`
+	Segment   string `json:"segment,omitempty" yaml:"segment,omitempty"`
+	// Until is the date the exemption expires, as YYYY-MM-DD.
+	Until  string `json:"until" yaml:"until"`
+	Reason string `json:"reason" yaml:"reason"`
+	Owner  string `json:"owner" yaml:"owner"`
+
+	expires time.Time
+}
+
+func (e exemption) key() string {
+	return ruleKey(internal.Recommendation{RuleData: internal.RuleData{Metric: e.Metric, MatchType: e.MatchType}})
+}
+
+func (e exemption) appliesTo(segment internal.Segment, rec internal.Recommendation) bool {
+	return (e.Segment == "" || e.Segment == segment.Name) && e.key() == ruleKey(rec)
+}
+
+func (e exemption) expired(now time.Time) bool {
+	return !now.Before(e.expires)
+}
+
+func (e exemption) String() string {
+	s := e.Metric
+	if e.MatchType != "" && e.MatchType != "exact" {
+		s += " (" + e.MatchType + ")"
+	}
+	if e.Segment != "" {
+		s += fmt.Sprintf(" in segment %q", e.Segment)
+	}
+	return s
+}
+
+// readExemptions reads and validates the exemptions in file.
+func readExemptions(file string) (*exemptionsConfig, error) {
+	config, err := readConfigFile[exemptionsConfig](file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read exemptions: %w", err)
+	}
+	if config.WarnDays == 0 {
+		config.WarnDays = defaultExemptionWarnDays
+	}
+
+	seen := map[string]bool{}
+	for i, e := range config.Exemptions {
+		if e.Metric == "" || e.Until == "" || e.Reason == "" || e.Owner == "" {
+			return nil, fmt.Errorf("invalid exemption %d in %s: metric, until, reason and owner are required", i+1, file)
+		}
+		config.Exemptions[i].expires, err = time.Parse(time.DateOnly, e.Until)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exemption %d in %s: until must be a date like 2006-01-02: %w", i+1, file, err)
+		}
+		key := e.Segment + "\x00" + e.key()
+		if seen[key] {
+			return nil, fmt.Errorf("invalid exemption %d in %s: %s is exempted more than once", i+1, file, e)
+		}
+		seen[key] = true
+	}
+	return &config, nil
+}
+
+// active returns the exemption that applies to the recommendation, if there is one that hasn't expired.
+func (c *exemptionsConfig) active(now time.Time, segment internal.Segment, rec internal.Recommendation) (exemption, bool) {
+	for _, e := range c.Exemptions {
+		if !e.expired(now) && e.appliesTo(segment, rec) {
+			return e, true
+		}
+	}
+	return exemption{}, false
+}
+
+// expiring returns the exemptions that expire within the warning period, and the ones that already expired.
+func (c *exemptionsConfig) expiring(now time.Time) (expiring, expired []exemption) {
+	warnFrom := now.AddDate(0, 0, c.WarnDays)
+	for _, e := range c.Exemptions {
+		switch {
+		case e.expired(now):
+			expired = append(expired, e)
+		case !warnFrom.Before(e.expires):
+			expiring = append(expiring, e)
+		}
+	}
+	return expiring, expired
+}
+
+// exemptRecommendations keeps the previous rule, or no rule, for the recommendations with an active exemption.
+func (c *exemptionsConfig) exemptRecommendations(now time.Time, segment internal.Segment, recs, oldRules []internal.Recommendation) ([]internal.Recommendation, []exemptedRecommendation) {
+	var kept []internal.Recommendation
+	var exempted []exemptedRecommendation
+	for _, rec := range recs {
+		e, ok := c.active(now, segment, rec)
+		if !ok || rec.RecommendedAction == "keep" {
+			kept = append(kept, rec)
+			continue
+		}
+
+		exempted = append(exempted, exemptedRecommendation{segment: segment.Name, rec: rec, exemption: e})
+		if previous, ok := keepPreviousRule(rec, oldRules); ok {
+			kept = append(kept, previous)
+		}
+	}
+	return kept, exempted
+}
+
+// logExpiring warns about exemptions that expire soon or have expired.
+func (c *exemptionsConfig) logExpiring(now time.Time) {
+	expiring, expired := c.expiring(now)
+	for _, e := range expiring {
+		log.Printf("warning: the exemption of %s expires on %s, ask %s whether it's still needed", e, e.Until, e.Owner)
+	}
+	for _, e := range expired {
+		log.Printf("warning: the exemption of %s expired on %s, remove it", e, e.Until)
+	}
+}
+
+type exemptedRecommendation struct {
+	segment   string
+	rec       internal.Recommendation
+	exemption exemption
+}
+
+func writeExemptions(output io.Writer, now time.Time, config *exemptionsConfig, exempted []exemptedRecommendation) {
+	if len(exempted) > 0 {
+		fmt.Fprintln(output, "## Exempted recommendations")
+		fmt.Fprintln(output, "| Segment | Metric | Action | Series Change | Until | Owner | Reason |")
+		fmt.Fprintln(output, "|---------|--------|--------|---------------|-------|-------|--------|")
+		for _, e := range exempted {
+			fmt.Fprintf(output, "| %s | %s | %s | %d | %s | %s | %s |\n", e.segment, e.rec.Metric, e.rec.RecommendedAction, e.rec.RecommendedSeriesCount-e.rec.CurrentSeriesCount, e.exemption.Until, e.exemption.Owner, e.exemption.Reason)
+		}
+	}
+
+	expiring, expired := config.expiring(now)
+	writeExemptionList(output, "Exemptions expiring soon", expiring)
+	writeExemptionList(output, "Expired exemptions", expired)
+}
+
+func writeExemptionList(output io.Writer, title string, exemptions []exemption) {
+	if len(exemptions) == 0 {
+		return
+	}
+	fmt.Fprintf(output, "## %s\n", title)
+	fmt.Fprintln(output, "| Exemption | Until | Owner | Reason |")
+	fmt.Fprintln(output, "|-----------|-------|-------|--------|")
+	for _, e := range exemptions {
+		fmt.Fprintf(output, "| %s | %s | %s | %s |\n", e, e.Until, e.Owner, e.Reason)
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/grafana/adaptive-metrics-autoapply/docker/internal"
+)
+
+// metricExplanation is everything known about the rules for a metric in one segment.
+type metricExplanation struct {
+	Segment        string                   `json:"segment"`
+	LocalFile      string                   `json:"local_file,omitempty"`
+	LocalRule      *internal.RuleData       `json:"local_rule"`
+	RemoteRule     *internal.RuleData       `json:"remote_rule"`
+	Recommendation *internal.Recommendation `json:"recommendation"`
+	History        []ruleHistoryEntry       `json:"history"`
+}
+
+// ruleHistoryEntry is a commit that changed the rule for a metric.
+type ruleHistoryEntry struct {
+	Commit  string             `json:"commit"`
+	Date    string             `json:"date"`
+	Author  string             `json:"author"`
+	Subject string             `json:"subject"`
+	Change  changeType         `json:"change"`
+	Rule    *internal.RuleData `json:"rule,omitempty"`
+}
+
+// explain shows why a metric is aggregated: the local and remote rules that apply to it, the current recommendation
+// and the commits that changed its rule, in every segment.
+func explain(args []string) {
+	flags := flag.NewFlagSet("explain", flag.ExitOnError)
+	cfg := loadConfig(flags, args)
+	workingDir := flags.String("working-dir", cfg.get(settingWorkingDir), "The path to the working directory.")
+	userAgent := flags.String("user-agent", cfg.get(settingUserAgent), "The user-agent to use when making requests against the API.")
+	outputFormat := flags.String("output", "text", "The output format, text or json.")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: adaptive-metrics explain [flags] <metric>")
+		flags.PrintDefaults()
+	}
+
+	err := flags.Parse(args)
+	if err != nil {
+		log.Fatalf("failed to parse flags: %v", err)
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	metric := flags.Arg(0)
+	if *outputFormat != "text" && *outputFormat != "json" {
+		log.Fatalf("invalid -output %q, must be one of: text, json", *outputFormat)
+	}
+
+	c := newClient(cfg, *userAgent)
+
+	segments, err := c.FetchSegments()
+	if err != nil {
+		log.Fatalf("failed to fetch segments: %v", err)
+	}
+	segments = append(segments, internal.DefaultSegment)
+
+	manifest, err := readSegmentManifest(*workingDir)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	explanations := []metricExplanation{}
+	for _, segment := range segments {
+		e := metricExplanation{Segment: segment.Name}
+
+		files, err := manifest.segmentFiles(*workingDir, segment)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Fatalf("failed to find the rule files of segment %s: %v", segment.Name, err)
+		}
+		// Match against the rules of all files at once, so that an exact match rule in one file takes precedence over
+		// a prefix or suffix rule in another, like it does when the rules are applied.
+		rules, definedIn, err := mergeRuleFilesWithSources(files)
+		if err != nil {
+			log.Fatalf("failed to read the rules of segment %s: %v", segment.Name, err)
+		}
+		if rule, ok := matchingRule(rules, metric); ok {
+			e.LocalFile, e.LocalRule = definedIn[ruleKey(rule)], &rule.RuleData
+		}
+		if len(files) > 0 {
+			e.History, err = ruleHistory(*workingDir, files, metric)
+			if err != nil {
+				log.Printf("skipping the history of segment %s: %v", segment.Name, err)
+			}
+		}
+
+		remote, _, err := c.GetRules(segment)
+		if err != nil {
+			log.Fatalf("failed to get the rules of segment %s: %v", segment.Name, err)
+		}
+		if rule, ok := matchingRule(remote, metric); ok {
+			e.RemoteRule = &rule.RuleData
+		}
+
+		recs, err := c.FetchRecommendations(segment, true)
+		if err != nil {
+			log.Fatalf("failed to fetch recommendations for segment %s: %v", segment.Name, err)
+		}
+		if rec, ok := matchingRule(recs, metric); ok {
+			e.Recommendation = &rec
+		}
+
+		if e.LocalRule != nil || e.RemoteRule != nil || e.Recommendation != nil || len(e.History) > 0 {
+			explanations = append(explanations, e)
+		}
+	}
+
+	if *outputFormat == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(struct {
+			Metric   string              `json:"metric"`
+			Segments []metricExplanation `json:"segments"`
+		}{metric, explanations})
+		if err != nil {
+			log.Fatalf("failed to write explanation: %v", err)
+		}
+		return
+	}
+	writeExplanation(os.Stdout, metric, explanations)
+}
+
+// matchingRule returns the rule that applies to the metric. Exact match rules take precedence, then the first
+// matching prefix or suffix rule wins.
+func matchingRule(rules []internal.Recommendation, metric string) (internal.Recommendation, bool) {
+	for _, rule := range rules {
+		if isExactMatch(rule) && rule.Metric == metric {
+			return rule, true
+		}
+	}
+	for _, rule := range rules {
+		if (rule.MatchType == "prefix" && strings.HasPrefix(metric, rule.Metric)) || (rule.MatchType == "suffix" && strings.HasSuffix(metric, rule.Metric)) {
+			return rule, true
+		}
+	}
+	return internal.Recommendation{}, false
+}
+
+// ruleHistory returns the commits that changed the rule for the metric in the files, oldest first.
+func ruleHistory(dir string, files []string, metric string) ([]ruleHistoryEntry, error) {
+	paths := make([]string, len(files))
+	for i, file := range files {
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return nil, err
+		}
+		paths[i] = filepath.ToSlash(rel)
+	}
+
+	out, err := git(dir, append([]string{"log", "--reverse", "--format=%H%x00%aI%x00%an%x00%s", "--"}, paths...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	var history []ruleHistoryEntry
+	var previous *internal.RuleData
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		fields := strings.SplitN(line, "\x00", 4)
+		if len(fields) != 4 {
+			continue
+		}
+
+		var rules []internal.Recommendation
+		for _, path := range paths {
+			data, err := git(dir, "show", fields[0]+":./"+path)
+			if err != nil {
+				// The file didn't exist yet, or was removed in this commit.
+				continue
+			}
+			fileRules, err := decodeRules(path, []byte(data))
+			if err != nil {
+				log.Printf("skipping %s in commit %s: %v", path, fields[0], err)
+				continue
+			}
+			rules = append(rules, fileRules...)
+		}
+		var current *internal.RuleData
+		if rule, ok := matchingRule(rules, metric); ok {
+			current = &rule.RuleData
+		}
+
+		var change changeType
+		switch {
+		case previous == nil && current == nil:
+			continue
+		case previous == nil:
+			change = changeAdd
+		case current == nil:
+			change = changeRemove
+		case !reflect.DeepEqual(*previous, *current):
+			change = changeModify
+		default:
+			continue
+		}
+
+		history = append(history, ruleHistoryEntry{Commit: fields[0], Date: fields[1], Author: fields[2], Subject: fields[3], Change: change, Rule: current})
+		previous = current
+	}
+	return history, nil
+}
+
+func git(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	stderr := new(bytes.Buffer)
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
+
+func writeExplanation(w io.Writer, metric string, explanations []metricExplanation) {
+	if len(explanations) == 0 {
+		fmt.Fprintf(w, "No rules or recommendations for %s in any segment.\n", metric)
+		return
+	}
+
+	for i, e := range explanations {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "Segment %q\n", e.Segment)
+
+		if e.LocalRule != nil {
+			fmt.Fprintf(w, "  Local rule in %s:\n    %s\n", e.LocalFile, formatExplainedRule(*e.LocalRule))
+		} else {
+			fmt.Fprintln(w, "  Local rule: none")
+		}
+		switch {
+		case e.RemoteRule == nil:
+			fmt.Fprintln(w, "  Remote rule: none")
+		case e.LocalRule != nil && sameRule(*e.LocalRule, *e.RemoteRule):
+			fmt.Fprintln(w, "  Remote rule: same as the local rule")
+		default:
+			fmt.Fprintf(w, "  Remote rule:\n    %s\n", formatExplainedRule(*e.RemoteRule))
+		}
+
+		if rec := e.Recommendation; rec != nil {
+			fmt.Fprintf(w, "  Recommendation: %s\n    %s\n", rec.RecommendedAction, formatExplainedRule(rec.RuleData))
+			fmt.Fprintf(w, "    Used in %d rules, %d queries and %d dashboards\n", rec.UsagesInRules, rec.UsagesInQueries, rec.UsagesInDashboards)
+			fmt.Fprintf(w, "    Series: %d raw, %d current, %d recommended\n", rec.RawSeriesCount, rec.CurrentSeriesCount, rec.RecommendedSeriesCount)
+		} else {
+			fmt.Fprintln(w, "  Recommendation: none")
+		}
+
+		if len(e.History) > 0 {
+			fmt.Fprintln(w, "  History:")
+			for _, h := range e.History {
+				date, _, _ := strings.Cut(h.Date, "T")
+				fmt.Fprintf(w, "    %s %.7s %s the rule: %s (%s)\n", date, h.Commit, pastTense(h.Change), h.Subject, h.Author)
+			}
+		}
+	}
+}
+
+// sameRule compares rules ignoring managed_by, which apply sets on the remote rules.
+func sameRule(a, b internal.RuleData) bool {
+	a.ManagedBy, b.ManagedBy = "", ""
+	return reflect.DeepEqual(a, b)
+}
+
+func formatExplainedRule(rule internal.RuleData) string {
+	rule.ManagedBy = ""
+	data, err := json.Marshal(rule)
+	if err != nil {
+		return fmt.Sprintf("%+v", rule)
+	}
+	return string(data)
+}
+
+func pastTense(c changeType) string {
+	switch c {
+	case changeAdd:
+		return "added"
+	case changeRemove:
+		return "removed"
+	default:
+		return "modified"
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestMatchingRuleAcrossFiles(t *testing.T) {
+	dir := t.TempDir()
+	prefix := filepath.Join(dir, "http.json")
+	exact := filepath.Join(dir, "recommended.yaml")
+	mustWriteFile(t, prefix, `[{"metric": "http_", "match_type": "prefix", "drop": true}]`)
+	mustWriteFile(t, exact, "- metric: http_requests_total\n  drop_labels: [pod]\n")
+
+	// The exact match rule wins, even though the prefix rule comes first.
+	rules, definedIn, err := mergeRuleFilesWithSources([]string{prefix, exact})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rule, ok := matchingRule(rules, "http_requests_total")
+	if !ok {
+		t.Fatal("matchingRule() found no rule")
+	}
+	if rule.Metric != "http_requests_total" || rule.MatchType != "" {
+		t.Errorf("matchingRule() = %s %q, want the exact match rule", matchTypeOf(rule), rule.Metric)
+	}
+	if got := definedIn[ruleKey(rule)]; got != exact {
+		t.Errorf("rule defined in %s, want %s", got, exact)
+	}
+
+	rule, ok = matchingRule(rules, "http_errors_total")
+	if !ok || rule.Metric != "http_" {
+		t.Errorf("matchingRule() = %q, %v, want the prefix rule", rule.Metric, ok)
+	}
+}
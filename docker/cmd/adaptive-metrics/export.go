@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/grafana/adaptive-metrics-autoapply/docker/internal"
+)
+
+func export(args []string) {
+	if len(args) < 1 {
+		log.Fatalf("missing export target, available targets: terraform, relabel, recording-rules")
+	}
+
+	switch args[0] {
+	case "terraform":
+		exportTerraform(args[1:])
+	case "relabel":
+		exportRelabel(args[1:])
+	case "recording-rules":
+		exportRecordingRules(args[1:])
+	default:
+		log.Fatalf("unknown export target %s, available targets: terraform, relabel, recording-rules", args[0])
+	}
+}
+
+// writeSegmentExport writes a generated file for the segment, with a header documenting which series it applies to.
+func writeSegmentExport(path, target string, segment internal.Segment, comment string, write func(w io.Writer) error) error {
+	out := new(strings.Builder)
+	fmt.Fprintf(out, "%s Generated by adaptive-metrics export %s. Do not edit by hand.\n", comment, target)
+	if segment == internal.DefaultSegment {
+		fmt.Fprintf(out, "%s Default segment: covers series that don't match the selector of any other segment.\n", comment)
+	} else {
+		fmt.Fprintf(out, "%s Segment %q: only applies to series that match the selector %s\n", comment, segment.Name, segment.Selector)
+	}
+	fmt.Fprintln(out)
+
+	if err := write(out); err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, []byte(out.String()), 0644)
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v3"
+
+	"github.com/grafana/adaptive-metrics-autoapply/docker/internal"
+)
+
+type ruleGroups struct {
+	Groups []ruleGroup `yaml:"groups"`
+}
+
+type ruleGroup struct {
+	Name     string          `yaml:"name"`
+	Interval model.Duration  `yaml:"interval,omitempty"`
+	Rules    []recordingRule `yaml:"rules"`
+}
+
+type recordingRule struct {
+	Record string `yaml:"record"`
+	Expr   string `yaml:"expr"`
+}
+
+// recordingRuleOperators maps Adaptive Metrics aggregations to the PromQL aggregation operator that emulates them.
+// sum:counter is handled separately, since summing raw counters breaks on the reset of any single series.
+var recordingRuleOperators = map[string]string{
+	"sum":   "sum",
+	"count": "count",
+	"min":   "min",
+	"max":   "max",
+}
+
+// defaultCounterRateWindow is the range of the rate of sum:counter aggregations for rules without an aggregation
+// interval. Rules with one use four times the interval, so that the range always holds a few samples.
+const defaultCounterRateWindow = model.Duration(5 * time.Minute)
+
+func exportRecordingRules(args []string) {
+	flags := flag.NewFlagSet("export recording-rules", flag.ExitOnError)
+	cfg := loadConfig(flags, args)
+	workingDir := flags.String("working-dir", cfg.get(settingWorkingDir), "The path to the working directory containing the rule files.")
+	outDir := flags.String("out-dir", "recording-rules", "The directory to write the rule groups to, relative to the working directory.")
+	userAgent := flags.String("user-agent", cfg.get(settingUserAgent), "The user-agent to use when making requests against the API.")
+
+	err := flags.Parse(args)
+	if err != nil {
+		log.Fatalf("failed to parse flags: %v", err)
+	}
+
+	c := newClient(cfg, *userAgent)
+
+	segments, err := c.FetchSegments()
+	if err != nil {
+		log.Fatalf("failed to fetch segments: %v", err)
+	}
+	segments = append(segments, internal.DefaultSegment)
+
+	manifest, err := readSegmentManifest(*workingDir)
+	if err != nil {
+		log.Fatalf("failed to read manifest: %v", err)
+	}
+
+	dir := filepath.Join(*workingDir, *outDir)
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		log.Fatalf("failed to create %s: %v", dir, err)
+	}
+
+	rulesBySegment := make([][]internal.Recommendation, len(segments))
+	for i, segment := range segments {
+		rulesBySegment[i], err = readSegmentRules(*workingDir, manifest, segment)
+		if err != nil {
+			log.Fatalf("failed to read rules for segment %s: %v", segment.Name, err)
+		}
+	}
+
+	for i, segment := range segments {
+		var excluded func(metric string) []string
+		if segment == internal.DefaultSegment {
+			excluded = func(metric string) []string { return segmentSelectorsOf(segments, rulesBySegment, metric) }
+		}
+
+		stem := manifest.stem(segment)
+		groups := recordingRuleGroups(segment, rulesBySegment[i], excluded)
+		if len(groups.Groups) == 0 {
+			log.Printf("no aggregation rules to export for segment %s", segment.Name)
+			if err := os.Remove(filepath.Join(dir, stem+".yaml")); err != nil && !os.IsNotExist(err) {
+				log.Fatalf("failed to remove stale rule groups for segment %s: %v", segment.Name, err)
+			}
+			continue
+		}
+
+		log.Printf("writing %d rule groups for segment %s to %s.yaml", len(groups.Groups), segment.Name, stem)
+		err = writeSegmentExport(filepath.Join(dir, stem+".yaml"), "recording-rules", segment, "#", func(w io.Writer) error {
+			writeRecordingRuleNotes(w, segment, groups)
+			enc := yaml.NewEncoder(w)
+			enc.SetIndent(2)
+			if err := enc.Encode(groups); err != nil {
+				return err
+			}
+			return enc.Close()
+		})
+		if err != nil {
+			log.Fatalf("failed to write rule groups for segment %s: %v", segment.Name, err)
+		}
+	}
+}
+
+// segmentSelectorsOf returns the selectors of the segments whose series the default segment's rule for the metric
+// doesn't apply to. That's every segment, except the ones that fall back to the default rules and have no rule of
+// their own for the metric.
+func segmentSelectorsOf(segments []internal.Segment, rulesBySegment [][]internal.Recommendation, metric string) []string {
+	var selectors []string
+	for i, segment := range segments {
+		if segment == internal.DefaultSegment {
+			continue
+		}
+		if segment.FallbackToDefault {
+			if _, ok := matchingRule(rulesBySegment[i], metric); !ok {
+				continue
+			}
+		}
+		if segment.Selector != "" && !slices.Contains(selectors, segment.Selector) {
+			selectors = append(selectors, segment.Selector)
+		}
+	}
+	return selectors
+}
+
+func writeRecordingRuleNotes(w io.Writer, segment internal.Segment, groups ruleGroups) {
+	counters := false
+	for _, group := range groups.Groups {
+		for _, rule := range group.Rules {
+			counters = counters || strings.HasSuffix(rule.Record, ":sum_rate")
+		}
+	}
+
+	if segment == internal.DefaultSegment {
+		fmt.Fprintln(w, "# The expressions leave out the series of the other segments with unless, so that they aren't counted twice.")
+	}
+	if counters {
+		fmt.Fprintln(w, "# sum:counter aggregations are recorded as the sum of the per-series rates, named <metric>:sum_rate, since the sum of")
+		fmt.Fprintln(w, "# raw counters breaks whenever a single series resets. Unlike Adaptive Metrics, they don't record a counter.")
+	}
+	fmt.Fprintln(w)
+}
+
+// recordingRuleGroups turns the aggregation rules of a segment into one rule group per aggregation interval, since
+// a rule group is evaluated at a single interval. Drop rules and rules that don't match a single metric are skipped.
+// For the default segment, excluded returns the selectors of the series that a rule for the metric doesn't apply to.
+func recordingRuleGroups(segment internal.Segment, rules []internal.Recommendation, excluded func(metric string) []string) ruleGroups {
+	var intervals []model.Duration
+	byInterval := map[model.Duration][]recordingRule{}
+	for _, rule := range rules {
+		if rule.Drop || (len(rule.KeepLabels) == 0 && len(rule.DropLabels) == 0) {
+			continue
+		}
+		if !isExactMatch(rule) {
+			log.Printf("skipping %s rule for %s in segment %s, a recording rule can only aggregate a single metric", rule.MatchType, rule.Metric, segment.Name)
+			continue
+		}
+
+		var exclude []string
+		if excluded != nil {
+			exclude = excluded(rule.Metric)
+		}
+		recorded := recordingRulesForRule(segment, rule, exclude)
+		if len(recorded) == 0 {
+			continue
+		}
+
+		if _, ok := byInterval[rule.AggregationInterval]; !ok {
+			intervals = append(intervals, rule.AggregationInterval)
+		}
+		byInterval[rule.AggregationInterval] = append(byInterval[rule.AggregationInterval], recorded...)
+	}
+
+	slices.Sort(intervals)
+
+	var groups ruleGroups
+	for _, interval := range intervals {
+		name := "adaptive-metrics-" + segment.Name
+		if interval != 0 {
+			name += "-" + interval.String()
+		}
+		groups.Groups = append(groups.Groups, ruleGroup{
+			Name:     name,
+			Interval: interval,
+			Rules:    byInterval[interval],
+		})
+	}
+	return groups
+}
+
+func recordingRulesForRule(segment internal.Segment, rule internal.Recommendation, exclude []string) []recordingRule {
+	// Fall back to a sum for rules that don't list their aggregations.
+	aggregations := rule.Aggregations
+	if len(aggregations) == 0 {
+		aggregations = []string{"sum"}
+	}
+
+	grouping := "without(" + strings.Join(rule.DropLabels, ", ") + ")"
+	if len(rule.KeepLabels) > 0 {
+		grouping = "by(" + strings.Join(rule.KeepLabels, ", ") + ")"
+	}
+
+	selector := rule.Metric
+	if segment != internal.DefaultSegment {
+		selector += segment.Selector
+	}
+
+	var recorded []recordingRule
+	seen := map[string]bool{}
+	for _, aggregation := range aggregations {
+		operator, ok := recordingRuleOperators[aggregation]
+		vector := seriesExpr(selector, rule.Metric, exclude, "")
+		record := rule.Metric + ":" + operator
+		if aggregation == "sum:counter" {
+			window := defaultCounterRateWindow
+			if rule.AggregationInterval != 0 {
+				window = 4 * rule.AggregationInterval
+			}
+			operator, ok = "sum", true
+			vector = seriesExpr(selector, rule.Metric, exclude, window.String())
+			record = rule.Metric + ":sum_rate"
+		}
+		if !ok {
+			log.Printf("skipping aggregation %s of %s in segment %s, it has no PromQL equivalent", aggregation, rule.Metric, segment.Name)
+			continue
+		}
+
+		if seen[record] {
+			continue
+		}
+		seen[record] = true
+
+		recorded = append(recorded, recordingRule{
+			Record: record,
+			Expr:   fmt.Sprintf("%s %s (%s)", operator, grouping, vector),
+		})
+	}
+	return recorded
+}
+
+// seriesExpr returns the series of the selector, or their rates over window if it's set, leaving out the series that
+// match any of the excluded selectors of the metric.
+func seriesExpr(selector, metric string, exclude []string, window string) string {
+	series := func(selector string) string {
+		if window == "" {
+			return selector
+		}
+		return fmt.Sprintf("rate(%s[%s])", selector, window)
+	}
+
+	expr := series(selector)
+	for _, e := range exclude {
+		expr += " unless " + series(metric+e)
+	}
+	return expr
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v3"
+
+	"github.com/grafana/adaptive-metrics-autoapply/docker/internal"
+)
+
+type relabelConfig struct {
+	SourceLabels []string `yaml:"source_labels,flow"`
+	Regex        string   `yaml:"regex"`
+	TargetLabel  string   `yaml:"target_label,omitempty"`
+	Replacement  *string  `yaml:"replacement,omitempty"`
+	Action       string   `yaml:"action"`
+}
+
+func exportRelabel(args []string) {
+	flags := flag.NewFlagSet("export relabel", flag.ExitOnError)
+	cfg := loadConfig(flags, args)
+	workingDir := flags.String("working-dir", cfg.get(settingWorkingDir), "The path to the working directory containing the rule files.")
+	outDir := flags.String("out-dir", "relabel", "The directory to write the relabel configs to, relative to the working directory.")
+	userAgent := flags.String("user-agent", cfg.get(settingUserAgent), "The user-agent to use when making requests against the API.")
+	dropLabels := flags.Bool("drop-labels", false, "Also remove the drop_labels of rules without aggregations. Only safe if the labels don't distinguish series.")
+	forwardTo := flags.String("alloy-forward-to", "prometheus.remote_write.default.receiver", "The receiver the generated Alloy prometheus.relabel components forward to.")
+
+	err := flags.Parse(args)
+	if err != nil {
+		log.Fatalf("failed to parse flags: %v", err)
+	}
+
+	c := newClient(cfg, *userAgent)
+
+	segments, err := c.FetchSegments()
+	if err != nil {
+		log.Fatalf("failed to fetch segments: %v", err)
+	}
+	segments = append(segments, internal.DefaultSegment)
+
+	manifest, err := readSegmentManifest(*workingDir)
+	if err != nil {
+		log.Fatalf("failed to read manifest: %v", err)
+	}
+
+	dir := filepath.Join(*workingDir, *outDir)
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		log.Fatalf("failed to create %s: %v", dir, err)
+	}
+
+	for _, segment := range segments {
+		rules, err := readSegmentRules(*workingDir, manifest, segment)
+		if err != nil {
+			log.Fatalf("failed to read rules for segment %s: %v", segment.Name, err)
+		}
+
+		stem := manifest.stem(segment)
+		configs := relabelConfigsForRules(rules, *dropLabels)
+		if len(configs) == 0 {
+			log.Printf("no rules to export for segment %s", segment.Name)
+			// Remove the output of a previous export, so it doesn't linger once the segment has no drop rules left.
+			for _, ext := range []string{".yaml", ".alloy"} {
+				if err := os.Remove(filepath.Join(dir, stem+ext)); err != nil && !os.IsNotExist(err) {
+					log.Fatalf("failed to remove stale relabel config for segment %s: %v", segment.Name, err)
+				}
+			}
+			continue
+		}
+
+		log.Printf("writing %d relabel configs for segment %s to %s.yaml and %s.alloy", len(configs), segment.Name, stem, stem)
+
+		err = writeSegmentExport(filepath.Join(dir, stem+".yaml"), "relabel", segment, "#", func(w io.Writer) error {
+			enc := yaml.NewEncoder(w)
+			enc.SetIndent(2)
+			if err := enc.Encode(map[string][]relabelConfig{"metric_relabel_configs": configs}); err != nil {
+				return err
+			}
+			return enc.Close()
+		})
+		if err != nil {
+			log.Fatalf("failed to write relabel config for segment %s: %v", segment.Name, err)
+		}
+
+		err = writeSegmentExport(filepath.Join(dir, stem+".alloy"), "relabel", segment, "//", func(w io.Writer) error {
+			writeAlloyRelabel(w, segment, configs, *forwardTo)
+			return nil
+		})
+		if err != nil {
+			log.Fatalf("failed to write Alloy config for segment %s: %v", segment.Name, err)
+		}
+	}
+}
+
+// relabelConfigsForRules turns drop rules into a single drop action on the metric name. When dropLabels is set,
+// rules that only drop labels also get one action per label. Prometheus' labeldrop can't be limited to a metric,
+// so those replace the label with an empty value instead, which removes it from matching series only.
+func relabelConfigsForRules(rules []internal.Recommendation, dropLabels bool) []relabelConfig {
+	var dropped []string
+	var configs []relabelConfig
+	for _, rule := range rules {
+		if rule.Drop {
+			dropped = append(dropped, metricNameRegex(rule))
+			continue
+		}
+
+		if !dropLabels || len(rule.Aggregations) > 0 {
+			continue
+		}
+
+		for _, label := range rule.DropLabels {
+			empty := ""
+			configs = append(configs, relabelConfig{
+				SourceLabels: []string{model.MetricNameLabel},
+				Regex:        metricNameRegex(rule),
+				TargetLabel:  label,
+				Replacement:  &empty,
+				Action:       "replace",
+			})
+		}
+	}
+
+	if len(dropped) == 0 {
+		return configs
+	}
+
+	slices.Sort(dropped)
+	drop := relabelConfig{
+		SourceLabels: []string{model.MetricNameLabel},
+		Regex:        strings.Join(dropped, "|"),
+		Action:       "drop",
+	}
+
+	// Drop first, there is no point in relabelling series that are dropped.
+	return append([]relabelConfig{drop}, configs...)
+}
+
+// metricNameRegex returns a regex matching the metric names the rule applies to. Prometheus anchors relabel regexes.
+func metricNameRegex(rule internal.Recommendation) string {
+	quoted := regexp.QuoteMeta(rule.Metric)
+	switch rule.MatchType {
+	case "prefix":
+		return quoted + ".*"
+	case "suffix":
+		return ".*" + quoted
+	default:
+		return quoted
+	}
+}
+
+var alloyInvalidChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// alloyRelabelLabel returns the label of the segment's prometheus.relabel component. Labels must be unique within a
+// config, so it's derived from the segment ID rather than the name, which may be "default" or differ only in characters
+// that Alloy labels can't contain.
+func alloyRelabelLabel(segment internal.Segment) string {
+	if segment.Identifier == "" {
+		return "adaptive_metrics_default"
+	}
+	// Alloy component labels may only contain letters, digits and underscores.
+	return "adaptive_metrics_segment_" + alloyInvalidChars.ReplaceAllString(segment.Identifier, "_")
+}
+
+func writeAlloyRelabel(w io.Writer, segment internal.Segment, configs []relabelConfig, forwardTo string) {
+	fmt.Fprintf(w, "prometheus.relabel %q {\n", alloyRelabelLabel(segment))
+	fmt.Fprintf(w, "  forward_to = [%s]\n", forwardTo)
+
+	for _, config := range configs {
+		attrs := [][2]string{
+			{"source_labels", "[" + strings.Join(quoteAll(config.SourceLabels), ", ") + "]"},
+			{"regex", strconv.Quote(config.Regex)},
+		}
+		if config.TargetLabel != "" {
+			attrs = append(attrs, [2]string{"target_label", strconv.Quote(config.TargetLabel)})
+		}
+		if config.Replacement != nil {
+			attrs = append(attrs, [2]string{"replacement", strconv.Quote(*config.Replacement)})
+		}
+		attrs = append(attrs, [2]string{"action", strconv.Quote(config.Action)})
+
+		width := 0
+		for _, attr := range attrs {
+			width = max(width, len(attr[0]))
+		}
+
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "  rule {")
+		for _, attr := range attrs {
+			fmt.Fprintf(w, "    %-*s = %s\n", width, attr[0], attr[1])
+		}
+		fmt.Fprintln(w, "  }")
+	}
+
+	fmt.Fprintln(w, "}")
+}
+
+func quoteAll(values []string) []string {
+	quoted := make([]string, 0, len(values))
+	for _, v := range values {
+		quoted = append(quoted, strconv.Quote(v))
+	}
+	return quoted
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/grafana/adaptive-metrics-autoapply/docker/internal"
+)
+
+func TestWriteAlloyRelabelLabelsAreUnique(t *testing.T) {
+	// These names all sanitize to the same label, and the first one is also the default segment's name.
+	segments := []internal.Segment{
+		internal.DefaultSegment,
+		{Identifier: "01HDEFAULT", Name: "default"},
+		{Identifier: "01HDASH", Name: "a-b"},
+		{Identifier: "01HDOT", Name: "a.b"},
+	}
+	configs := []relabelConfig{{SourceLabels: []string{"__name__"}, Regex: "up", Action: "drop"}}
+
+	seen := map[string]string{}
+	for _, segment := range segments {
+		out := new(strings.Builder)
+		writeAlloyRelabel(out, segment, configs, "prometheus.remote_write.default.receiver")
+
+		header, _, _ := strings.Cut(out.String(), "\n")
+		if other, ok := seen[header]; ok {
+			t.Errorf("segments %q and %q both export %s", other, segment.Name, header)
+		}
+		seen[header] = segment.Name
+	}
+
+	out := new(strings.Builder)
+	writeAlloyRelabel(out, segments[3], configs, "prometheus.remote_write.default.receiver")
+	if want := `prometheus.relabel "adaptive_metrics_segment_01HDOT" {`; !strings.HasPrefix(out.String(), want+"\n") {
+		t.Errorf("writeAlloyRelabel() = %q, want it to start with %q", out.String(), want)
+	}
+}
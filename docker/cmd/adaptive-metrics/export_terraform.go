@@ -0,0 +1,270 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/grafana/adaptive-metrics-autoapply/docker/internal"
+)
+
+const (
+	terraformRuleResource    = "grafana-adaptive-metrics_rule"
+	terraformSegmentResource = "grafana-adaptive-metrics_segment"
+)
+
+func exportTerraform(args []string) {
+	flags := flag.NewFlagSet("export terraform", flag.ExitOnError)
+	cfg := loadConfig(flags, args)
+	workingDir := flags.String("working-dir", cfg.get(settingWorkingDir), "The path to the working directory containing the rule files.")
+	outDir := flags.String("out-dir", "terraform", "The directory to write the Terraform files to, relative to the working directory.")
+	userAgent := flags.String("user-agent", cfg.get(settingUserAgent), "The user-agent to use when making requests against the API.")
+	imports := flags.Bool("imports", true, "Emit import blocks for the segments and rules that already exist in Grafana Cloud.")
+
+	err := flags.Parse(args)
+	if err != nil {
+		log.Fatalf("failed to parse flags: %v", err)
+	}
+
+	c := newClient(cfg, *userAgent)
+
+	segments, err := c.FetchSegments()
+	if err != nil {
+		log.Fatalf("failed to fetch segments: %v", err)
+	}
+	segments = append(segments, internal.DefaultSegment)
+
+	manifest, err := readSegmentManifest(*workingDir)
+	if err != nil {
+		log.Fatalf("failed to read manifest: %v", err)
+	}
+
+	rulesBySegment := make([][]internal.Recommendation, len(segments))
+	remoteBySegment := make([][]internal.Recommendation, len(segments))
+	for i, segment := range segments {
+		rulesBySegment[i], err = readSegmentRules(*workingDir, manifest, segment)
+		if err != nil {
+			log.Fatalf("failed to read rules for segment %s: %v", segment.Name, err)
+		}
+
+		if *imports {
+			remoteBySegment[i], _, err = c.GetRules(segment)
+			if err != nil {
+				log.Fatalf("failed to get current rules for segment %s: %v", segment.Name, err)
+			}
+		}
+	}
+
+	dir := filepath.Join(*workingDir, *outDir)
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		log.Fatalf("failed to create %s: %v", dir, err)
+	}
+
+	err = writeTerraformFile(filepath.Join(dir, "versions.tf"), func(w io.Writer) {
+		fmt.Fprintln(w, "terraform {")
+		fmt.Fprintln(w, "  required_providers {")
+		fmt.Fprintln(w, "    grafana-adaptive-metrics = {")
+		fmt.Fprintln(w, `      source = "grafana/grafana-adaptive-metrics"`)
+		fmt.Fprintln(w, "    }")
+		fmt.Fprintln(w, "  }")
+		fmt.Fprintln(w, "}")
+	})
+	if err != nil {
+		log.Fatalf("failed to write versions.tf: %v", err)
+	}
+
+	for i, segment := range segments {
+		filename := manifest.stem(segment) + ".tf"
+		log.Printf("writing %d rules for segment %s to %s", len(rulesBySegment[i]), segment.Name, filename)
+		err = writeTerraformFile(filepath.Join(dir, filename), func(w io.Writer) {
+			writeTerraformSegment(w, segment, rulesBySegment[i], remoteBySegment[i], *imports)
+		})
+		if err != nil {
+			log.Fatalf("failed to write %s: %v", filename, err)
+		}
+	}
+}
+
+func writeTerraformFile(path string, write func(w io.Writer)) error {
+	out := new(strings.Builder)
+	fmt.Fprintln(out, "# Generated by adaptive-metrics export terraform. Do not edit by hand.")
+	fmt.Fprintln(out)
+	write(out)
+
+	return os.WriteFile(path, []byte(out.String()), 0644)
+}
+
+func writeTerraformSegment(w io.Writer, segment internal.Segment, rules, remote []internal.Recommendation, imports bool) {
+	if segment != internal.DefaultSegment {
+		fmt.Fprintf(w, "# Segment %q, selector %q.\n", segment.Name, segment.Selector)
+		segmentAttrs := [][2]string{
+			{"name", hclString(segment.Name)},
+			{"selector", hclString(segment.Selector)},
+		}
+		if segment.FallbackToDefault {
+			segmentAttrs = append(segmentAttrs, [2]string{"fallback_to_default", "true"})
+		}
+		writeHCLBlock(w, fmt.Sprintf("resource %q %q", terraformSegmentResource, terraformSegmentName(segment)), segmentAttrs)
+
+		if imports {
+			writeHCLBlock(w, "import", [][2]string{
+				{"to", terraformSegmentResource + "." + terraformSegmentName(segment)},
+				{"id", hclString(segment.Identifier)},
+			})
+		}
+	} else {
+		fmt.Fprintln(w, "# Default segment.")
+		fmt.Fprintln(w)
+	}
+
+	// Individual rule resources carry no ordering, so the first matching prefix or suffix rule may differ once applied.
+	for _, rule := range rules {
+		if !isExactMatch(rule) {
+			log.Printf("segment %s has %s rules, whose relative order is not preserved by Terraform", segment.Name, rule.MatchType)
+			break
+		}
+	}
+
+	existing := map[string]bool{}
+	for _, rule := range remote {
+		existing[ruleKey(rule)] = true
+	}
+
+	for _, rule := range rules {
+		if rule.Ingest {
+			log.Printf("ignoring ingest for metric %s in segment %s, it is not supported by the Terraform provider", rule.Metric, segment.Name)
+		}
+
+		name := terraformRuleName(segment, rule)
+		writeHCLBlock(w, fmt.Sprintf("resource %q %q", terraformRuleResource, name), terraformRuleAttributes(segment, rule))
+
+		if imports && existing[ruleKey(rule)] {
+			writeHCLBlock(w, "import", [][2]string{
+				{"to", terraformRuleResource + "." + name},
+				{"id", hclString(terraformRuleImportID(segment, rule))},
+			})
+		}
+	}
+}
+
+func terraformRuleAttributes(segment internal.Segment, rule internal.Recommendation) [][2]string {
+	var attrs [][2]string
+	if segment != internal.DefaultSegment {
+		attrs = append(attrs, [2]string{"segment", terraformSegmentResource + "." + terraformSegmentName(segment) + ".id"})
+	}
+	attrs = append(attrs, [2]string{"metric", hclString(rule.Metric)})
+	if rule.MatchType != "" {
+		attrs = append(attrs, [2]string{"match_type", hclString(rule.MatchType)})
+	}
+	if rule.Drop {
+		attrs = append(attrs, [2]string{"drop", "true"})
+	}
+	if len(rule.KeepLabels) > 0 {
+		attrs = append(attrs, [2]string{"keep_labels", hclStringList(rule.KeepLabels)})
+	}
+	if len(rule.DropLabels) > 0 {
+		attrs = append(attrs, [2]string{"drop_labels", hclStringList(rule.DropLabels)})
+	}
+	if len(rule.Aggregations) > 0 {
+		attrs = append(attrs, [2]string{"aggregations", hclStringList(rule.Aggregations)})
+	}
+	if rule.AggregationInterval != 0 {
+		attrs = append(attrs, [2]string{"aggregation_interval", hclString(rule.AggregationInterval.String())})
+	}
+	if rule.AggregationDelay != 0 {
+		attrs = append(attrs, [2]string{"aggregation_delay", hclString(rule.AggregationDelay.String())})
+	}
+	return attrs
+}
+
+// terraformRuleImportID returns the ID the provider expects when importing a rule.
+func terraformRuleImportID(segment internal.Segment, rule internal.Recommendation) string {
+	if segment == internal.DefaultSegment {
+		return rule.Metric
+	}
+	return segment.Identifier + "/" + rule.Metric
+}
+
+// terraformSegmentName returns the resource name of the segment. It's derived from the segment ID, so that it
+// doesn't change when the segment is renamed.
+func terraformSegmentName(segment internal.Segment) string {
+	return "segment_" + terraformInvalidChars.ReplaceAllString(segment.Identifier, "_")
+}
+
+// terraformRuleName returns the resource name of the rule. The metric keeps it readable, and a hash of the segment ID,
+// match type and metric makes it unique, so that it never depends on the other rules or on the segment's name.
+func terraformRuleName(segment internal.Segment, rule internal.Recommendation) string {
+	h := fnv.New64a()
+	_, _ = io.WriteString(h, segment.Identifier+"\x00"+ruleKey(rule))
+	name := terraformIdentifier(rule.Metric)
+	if !isExactMatch(rule) {
+		name += "_" + terraformIdentifier(rule.MatchType)
+	}
+	return fmt.Sprintf("%s_%012x", name, h.Sum64()&0xffffffffffff)
+}
+
+var terraformInvalidChars = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+func terraformIdentifier(s string) string {
+	id := terraformInvalidChars.ReplaceAllString(s, "_")
+	if id == "" || (id[0] >= '0' && id[0] <= '9') || id[0] == '-' {
+		id = "_" + id
+	}
+	return id
+}
+
+func writeHCLBlock(w io.Writer, header string, attrs [][2]string) {
+	width := 0
+	for _, attr := range attrs {
+		width = max(width, len(attr[0]))
+	}
+
+	fmt.Fprintf(w, "%s {\n", header)
+	for _, attr := range attrs {
+		fmt.Fprintf(w, "  %-*s = %s\n", width, attr[0], attr[1])
+	}
+	fmt.Fprint(w, "}\n\n")
+}
+
+func hclStringList(values []string) string {
+	quoted := make([]string, 0, len(values))
+	for _, v := range values {
+		quoted = append(quoted, hclString(v))
+	}
+	return "[" + strings.Join(quoted, ", ") + "]"
+}
+
+func hclString(s string) string {
+	out := new(strings.Builder)
+	out.WriteByte('"')
+	for i, r := range s {
+		switch {
+		case r == '"' || r == '\\':
+			out.WriteByte('\\')
+			out.WriteRune(r)
+		case r == '\n':
+			out.WriteString(`\n`)
+		case r == '\r':
+			out.WriteString(`\r`)
+		case r == '\t':
+			out.WriteString(`\t`)
+		case r < 0x20:
+			fmt.Fprintf(out, `\u%04x`, r)
+		case (r == '$' || r == '%') && strings.HasPrefix(s[i+1:], "{"):
+			// Escape template sequences, which HCL would otherwise interpolate.
+			out.WriteRune(r)
+			out.WriteRune(r)
+		default:
+			out.WriteRune(r)
+		}
+	}
+	out.WriteByte('"')
+	return out.String()
+}
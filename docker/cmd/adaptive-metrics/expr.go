@@ -0,0 +1,482 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/grafana/adaptive-metrics-autoapply/docker/internal"
+)
+
+// This file implements a small expression language over the fields of a recommendation, for example:
+//
+//	recommended_action == "add" && usages_in_dashboards == 0 && metric !~ "^kube_"
+//
+// Fields are named after the JSON fields of a verbose recommendation. Expressions are type-checked when they're
+// compiled, so that mistakes surface when the config is loaded rather than halfway through a pull.
+
+type exprType int
+
+const (
+	typeBool exprType = iota
+	typeNumber
+	typeString
+	typeList
+)
+
+func (t exprType) String() string {
+	switch t {
+	case typeBool:
+		return "bool"
+	case typeNumber:
+		return "number"
+	case typeString:
+		return "string"
+	default:
+		return "list"
+	}
+}
+
+// exprError is an error at a position of the expression. The parser records byte offsets, which compileExpr turns
+// into rune offsets, so that the column and the marker line up with the characters of the expression.
+type exprError struct {
+	pos int
+	msg string
+}
+
+func (e *exprError) Error() string {
+	return fmt.Sprintf("column %d: %s", e.pos+1, e.msg)
+}
+
+func exprErrorf(pos int, format string, args ...any) *exprError {
+	return &exprError{pos: pos, msg: fmt.Sprintf(format, args...)}
+}
+
+// describeExprError formats the error with the expression and a marker under the offending token.
+func describeExprError(expr string, err error) string {
+	e, ok := err.(*exprError)
+	if !ok {
+		return err.Error()
+	}
+	return fmt.Sprintf("%s\n\t%s\n\t%s^", e, expr, strings.Repeat(" ", e.pos))
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenNumber
+	tokenString
+	tokenOperator
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+var exprOperators = []string{"&&", "||", "==", "!=", "<=", ">=", "=~", "!~", "<", ">", "!", "+", "-", "*", "/", "(", ")"}
+
+func tokenize(expr string) ([]token, error) {
+	var tokens []token
+	for pos := 0; pos < len(expr); {
+		c, size := utf8.DecodeRuneInString(expr[pos:])
+		switch {
+		case unicode.IsSpace(c):
+			pos += size
+		case c == '_' || unicode.IsLetter(c):
+			end := scanWhile(expr, pos+size, func(r rune) bool { return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r) })
+			tokens = append(tokens, token{kind: tokenIdent, text: expr[pos:end], pos: pos})
+			pos = end
+		case unicode.IsDigit(c):
+			end := scanWhile(expr, pos+size, func(r rune) bool { return unicode.IsDigit(r) || r == '.' || r == '_' })
+			tokens = append(tokens, token{kind: tokenNumber, text: expr[pos:end], pos: pos})
+			pos = end
+		case c == '"' || c == '`':
+			// Quotes are ASCII, and UTF-8 continuation bytes never are, so the closing quote can be found bytewise.
+			end := pos + 1
+			for end < len(expr) && rune(expr[end]) != c {
+				if c == '"' && expr[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(expr) {
+				return nil, exprErrorf(pos, "unterminated string")
+			}
+			tokens = append(tokens, token{kind: tokenString, text: expr[pos : end+1], pos: pos})
+			pos = end + 1
+		default:
+			i := slices.IndexFunc(exprOperators, func(op string) bool { return strings.HasPrefix(expr[pos:], op) })
+			if i < 0 {
+				return nil, exprErrorf(pos, "unexpected character %q", c)
+			}
+			tokens = append(tokens, token{kind: tokenOperator, text: exprOperators[i], pos: pos})
+			pos += len(exprOperators[i])
+		}
+	}
+	return append(tokens, token{kind: tokenEOF, pos: len(expr)}), nil
+}
+
+// scanWhile returns the byte offset of the first rune from pos on that doesn't satisfy f.
+func scanWhile(expr string, pos int, f func(rune) bool) int {
+	for pos < len(expr) {
+		r, size := utf8.DecodeRuneInString(expr[pos:])
+		if !f(r) {
+			break
+		}
+		pos += size
+	}
+	return pos
+}
+
+// exprNode is a type-checked node of an expression.
+type exprNode struct {
+	typ  exprType
+	eval func(rec internal.Recommendation) any
+}
+
+// exprFields maps the JSON names of the recommendation's fields to their getters.
+var exprFields = func() map[string]exprNode {
+	fields := map[string]exprNode{}
+	var add func(t reflect.Type, index []int)
+	add = func(t reflect.Type, index []int) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			fieldIndex := append(slices.Clone(index), i)
+			if f.Anonymous {
+				add(f.Type, fieldIndex)
+				continue
+			}
+
+			name := strings.Split(f.Tag.Get("json"), ",")[0]
+			get := func(rec internal.Recommendation) reflect.Value {
+				return reflect.ValueOf(rec).FieldByIndex(fieldIndex)
+			}
+			switch {
+			case f.Type == reflect.TypeOf(model.Duration(0)):
+				fields[name] = exprNode{typ: typeString, eval: func(rec internal.Recommendation) any {
+					d := get(rec).Interface().(model.Duration)
+					if d == 0 {
+						return ""
+					}
+					return d.String()
+				}}
+			case f.Type.Kind() == reflect.Bool:
+				fields[name] = exprNode{typ: typeBool, eval: func(rec internal.Recommendation) any { return get(rec).Bool() }}
+			case f.Type.Kind() == reflect.Int:
+				fields[name] = exprNode{typ: typeNumber, eval: func(rec internal.Recommendation) any { return float64(get(rec).Int()) }}
+			case f.Type.Kind() == reflect.String:
+				fields[name] = exprNode{typ: typeString, eval: func(rec internal.Recommendation) any { return get(rec).String() }}
+			case f.Type == reflect.TypeOf([]string(nil)):
+				fields[name] = exprNode{typ: typeList, eval: func(rec internal.Recommendation) any { return get(rec).Interface().([]string) }}
+			}
+		}
+	}
+	add(reflect.TypeOf(internal.Recommendation{}), nil)
+	return fields
+}()
+
+type exprParser struct {
+	tokens []token
+	pos    int
+}
+
+// compileExpr parses and type-checks a boolean expression.
+func compileExpr(expr string) (func(rec internal.Recommendation) bool, error) {
+	match, err := parseExpr(expr)
+	if e, ok := err.(*exprError); ok {
+		e.pos = utf8.RuneCountInString(expr[:e.pos])
+	}
+	return match, err
+}
+
+func parseExpr(expr string) (func(rec internal.Recommendation) bool, error) {
+	tokens, err := tokenize(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &exprParser{tokens: tokens}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, exprErrorf(t.pos, "unexpected %q", t.text)
+	}
+	if node.typ != typeBool {
+		return nil, exprErrorf(0, "expression is a %s, not a bool", node.typ)
+	}
+
+	return func(rec internal.Recommendation) bool { return node.eval(rec).(bool) }, nil
+}
+
+func (p *exprParser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *exprParser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+// accept consumes the next token if it's one of the given operators or keywords.
+func (p *exprParser) accept(ops ...string) (token, bool) {
+	t := p.peek()
+	if (t.kind == tokenOperator || t.kind == tokenIdent) && slices.Contains(ops, t.text) {
+		return p.next(), true
+	}
+	return t, false
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	return p.parseLogical("||", p.parseAnd)
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	return p.parseLogical("&&", p.parseNot)
+}
+
+func (p *exprParser) parseLogical(op string, operand func() (exprNode, error)) (exprNode, error) {
+	left, err := operand()
+	if err != nil {
+		return exprNode{}, err
+	}
+	for {
+		t, ok := p.accept(op)
+		if !ok {
+			return left, nil
+		}
+		right, err := operand()
+		if err != nil {
+			return exprNode{}, err
+		}
+		if left.typ != typeBool || right.typ != typeBool {
+			return exprNode{}, exprErrorf(t.pos, "%s needs bool operands, got %s and %s", op, left.typ, right.typ)
+		}
+
+		l, r := left, right
+		if op == "&&" {
+			left = exprNode{typ: typeBool, eval: func(rec internal.Recommendation) any { return l.eval(rec).(bool) && r.eval(rec).(bool) }}
+		} else {
+			left = exprNode{typ: typeBool, eval: func(rec internal.Recommendation) any { return l.eval(rec).(bool) || r.eval(rec).(bool) }}
+		}
+	}
+}
+
+func (p *exprParser) parseNot() (exprNode, error) {
+	t, ok := p.accept("!")
+	if !ok {
+		return p.parseComparison()
+	}
+	operand, err := p.parseNot()
+	if err != nil {
+		return exprNode{}, err
+	}
+	if operand.typ != typeBool {
+		return exprNode{}, exprErrorf(t.pos, "! needs a bool operand, got %s", operand.typ)
+	}
+	return exprNode{typ: typeBool, eval: func(rec internal.Recommendation) any { return !operand.eval(rec).(bool) }}, nil
+}
+
+func (p *exprParser) parseComparison() (exprNode, error) {
+	left, err := p.parseAdditive()
+	if err != nil {
+		return exprNode{}, err
+	}
+
+	t, ok := p.accept("==", "!=", "<", "<=", ">", ">=", "=~", "!~", "in")
+	if !ok {
+		return left, nil
+	}
+
+	if t.text == "=~" || t.text == "!~" {
+		return p.parseMatch(t, left)
+	}
+
+	right, err := p.parseAdditive()
+	if err != nil {
+		return exprNode{}, err
+	}
+
+	switch t.text {
+	case "in":
+		if left.typ != typeString || right.typ != typeList {
+			return exprNode{}, exprErrorf(t.pos, "in needs a string and a list, got %s and %s", left.typ, right.typ)
+		}
+		return exprNode{typ: typeBool, eval: func(rec internal.Recommendation) any {
+			return slices.Contains(right.eval(rec).([]string), left.eval(rec).(string))
+		}}, nil
+	case "==", "!=":
+		if left.typ != right.typ || left.typ == typeList {
+			return exprNode{}, exprErrorf(t.pos, "can't compare %s with %s", left.typ, right.typ)
+		}
+		equal := t.text == "=="
+		return exprNode{typ: typeBool, eval: func(rec internal.Recommendation) any {
+			return (left.eval(rec) == right.eval(rec)) == equal
+		}}, nil
+	default:
+		if left.typ != right.typ || (left.typ != typeNumber && left.typ != typeString) {
+			return exprNode{}, exprErrorf(t.pos, "%s needs two numbers or two strings, got %s and %s", t.text, left.typ, right.typ)
+		}
+		op := t.text
+		return exprNode{typ: typeBool, eval: func(rec internal.Recommendation) any {
+			var c int
+			if left.typ == typeNumber {
+				c = cmp.Compare(left.eval(rec).(float64), right.eval(rec).(float64))
+			} else {
+				c = strings.Compare(left.eval(rec).(string), right.eval(rec).(string))
+			}
+			switch op {
+			case "<":
+				return c < 0
+			case "<=":
+				return c <= 0
+			case ">":
+				return c > 0
+			default:
+				return c >= 0
+			}
+		}}, nil
+	}
+}
+
+// parseMatch parses the regular expression of =~ or !~, which must be a string literal so it's compiled only once.
+func (p *exprParser) parseMatch(op token, left exprNode) (exprNode, error) {
+	t := p.next()
+	if t.kind != tokenString {
+		return exprNode{}, exprErrorf(t.pos, "%s needs a string literal on the right", op.text)
+	}
+	if left.typ != typeString {
+		return exprNode{}, exprErrorf(op.pos, "%s needs a string on the left, got %s", op.text, left.typ)
+	}
+
+	pattern, err := strconv.Unquote(t.text)
+	if err != nil {
+		return exprNode{}, exprErrorf(t.pos, "invalid string: %v", err)
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return exprNode{}, exprErrorf(t.pos, "invalid regular expression: %v", err)
+	}
+
+	match := op.text == "=~"
+	return exprNode{typ: typeBool, eval: func(rec internal.Recommendation) any {
+		return re.MatchString(left.eval(rec).(string)) == match
+	}}, nil
+}
+
+func (p *exprParser) parseAdditive() (exprNode, error) {
+	return p.parseArithmetic([]string{"+", "-"}, p.parseMultiplicative)
+}
+
+func (p *exprParser) parseMultiplicative() (exprNode, error) {
+	return p.parseArithmetic([]string{"*", "/"}, p.parseUnary)
+}
+
+func (p *exprParser) parseArithmetic(ops []string, operand func() (exprNode, error)) (exprNode, error) {
+	left, err := operand()
+	if err != nil {
+		return exprNode{}, err
+	}
+	for {
+		t, ok := p.accept(ops...)
+		if !ok {
+			return left, nil
+		}
+		right, err := operand()
+		if err != nil {
+			return exprNode{}, err
+		}
+		if left.typ != typeNumber || right.typ != typeNumber {
+			return exprNode{}, exprErrorf(t.pos, "%s needs numbers, got %s and %s", t.text, left.typ, right.typ)
+		}
+
+		l, r, op := left, right, t.text
+		left = exprNode{typ: typeNumber, eval: func(rec internal.Recommendation) any {
+			a, b := l.eval(rec).(float64), r.eval(rec).(float64)
+			switch op {
+			case "+":
+				return a + b
+			case "-":
+				return a - b
+			case "*":
+				return a * b
+			default:
+				return a / b
+			}
+		}}
+	}
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	t, ok := p.accept("-")
+	if !ok {
+		return p.parsePrimary()
+	}
+	operand, err := p.parseUnary()
+	if err != nil {
+		return exprNode{}, err
+	}
+	if operand.typ != typeNumber {
+		return exprNode{}, exprErrorf(t.pos, "- needs a number, got %s", operand.typ)
+	}
+	return exprNode{typ: typeNumber, eval: func(rec internal.Recommendation) any { return -operand.eval(rec).(float64) }}, nil
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenNumber:
+		n, err := strconv.ParseFloat(strings.ReplaceAll(t.text, "_", ""), 64)
+		if err != nil {
+			return exprNode{}, exprErrorf(t.pos, "invalid number %q", t.text)
+		}
+		return exprNode{typ: typeNumber, eval: func(internal.Recommendation) any { return n }}, nil
+	case tokenString:
+		s, err := strconv.Unquote(t.text)
+		if err != nil {
+			return exprNode{}, exprErrorf(t.pos, "invalid string: %v", err)
+		}
+		return exprNode{typ: typeString, eval: func(internal.Recommendation) any { return s }}, nil
+	case tokenIdent:
+		switch t.text {
+		case "true", "false":
+			b := t.text == "true"
+			return exprNode{typ: typeBool, eval: func(internal.Recommendation) any { return b }}, nil
+		}
+		field, ok := exprFields[t.text]
+		if !ok {
+			return exprNode{}, exprErrorf(t.pos, "unknown field %q", t.text)
+		}
+		return field, nil
+	case tokenOperator:
+		if t.text == "(" {
+			node, err := p.parseOr()
+			if err != nil {
+				return exprNode{}, err
+			}
+			if closing := p.next(); closing.text != ")" || closing.kind != tokenOperator {
+				return exprNode{}, exprErrorf(closing.pos, "expected )")
+			}
+			return node, nil
+		}
+		return exprNode{}, exprErrorf(t.pos, "unexpected %q", t.text)
+	default:
+		return exprNode{}, exprErrorf(t.pos, "unexpected end of expression")
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/grafana/adaptive-metrics-autoapply/docker/internal"
+)
+
+func TestCompileExpr(t *testing.T) {
+	rec := internal.Recommendation{
+		RuleData: internal.RuleData{
+			Metric:     "kube_pod_info",
+			DropLabels: []string{"pod", "instance"},
+		},
+		RecommendedAction:  "add",
+		UsagesInRules:      2,
+		UsagesInDashboards: 0,
+	}
+
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{`recommended_action == "add" && usages_in_dashboards == 0 && metric !~ "^kube_"`, false},
+		{`recommended_action == "add" && usages_in_dashboards == 0 && metric =~ "^kube_"`, true},
+
+		// Arithmetic binds tighter than comparisons, * and / tighter than + and -.
+		{`1 + 2 * 3 == 7`, true},
+		{`(1 + 2) * 3 == 9`, true},
+		{`10 - 4 - 3 == 3`, true},
+		{`10 / 4 == 2.5`, true},
+		{`-2 * 3 == -6`, true},
+		{`1_000 == 1000`, true},
+		{`usages_in_rules * 2 > 3`, true},
+
+		// ! binds tighter than &&, and && tighter than ||.
+		{`!false && true`, true},
+		{`!(false || true)`, false},
+		{`true || false && false`, true},
+		{`false && true || true`, true},
+		{`false && (true || true)`, false},
+		{`!!true`, true},
+
+		{`metric =~ "kube_"`, true},
+		{`metric =~ "^pod"`, false},
+		{`metric !~ "^node_"`, true},
+		{"metric =~ `^kube_\\w+$`", true},
+		{`metric < "l"`, true},
+		{`"pod" in drop_labels`, true},
+		{`"job" in drop_labels`, false},
+		{`match_type == ""`, true},
+		{`aggregation_interval == ""`, true},
+		{`drop == false`, true},
+		{`metric != "ü" && true`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			match, err := compileExpr(tt.expr)
+			if err != nil {
+				t.Fatalf("compileExpr() error = %v", err)
+			}
+			if got := match(rec); got != tt.want {
+				t.Errorf("match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompileExprErrors(t *testing.T) {
+	tests := []struct {
+		expr   string
+		msg    string
+		column int
+	}{
+		{`metric =~ "("`, "invalid regular expression", 11},
+		{`metric !~ "[a-"`, "invalid regular expression", 11},
+		{`metric =~ metric`, "=~ needs a string literal on the right", 11},
+		{`usages_in_rules =~ "a"`, "=~ needs a string on the left, got number", 17},
+		{`usages_in_rules == "a"`, "can't compare number with string", 17},
+		{`metric > 1`, "> needs two numbers or two strings, got string and number", 8},
+		{`metric + 1 > 0`, "+ needs numbers, got string and number", 8},
+		{`-metric == 1`, "- needs a number, got string", 1},
+		{`"pod" in metric`, "in needs a string and a list, got string and string", 7},
+		{`drop_labels == drop_labels`, "can't compare list with list", 13},
+		{`true && 1`, "&& needs bool operands, got bool and number", 6},
+		{`1 || true`, "|| needs bool operands, got number and bool", 3},
+		{`!metric`, "! needs a bool operand, got string", 1},
+		{`usages_in_rules`, "expression is a number, not a bool", 1},
+		{`unknown_field == 1`, `unknown field "unknown_field"`, 1},
+
+		// Running out of input.
+		{`metric ==`, "unexpected end of expression", 10},
+		{`true &&`, "unexpected end of expression", 8},
+		{`!`, "unexpected end of expression", 2},
+		{`(true`, "expected )", 6},
+		{`metric =~`, "=~ needs a string literal on the right", 10},
+		{`metric == "abc`, "unterminated string", 11},
+		{`true true`, `unexpected "true"`, 6},
+		{`)`, `unexpected ")"`, 1},
+
+		// Columns count characters, not bytes.
+		{`"ü" == 1`, "can't compare string with number", 5},
+		{`metric == "a" && €`, "unexpected character '€'", 18},
+		{`ünknown == 1`, `unknown field "ünknown"`, 1},
+		{`"日本" == "x" && größe > 1`, `unknown field "größe"`, 16},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			_, err := compileExpr(tt.expr)
+			if err == nil {
+				t.Fatalf("compileExpr() error = nil, want %q", tt.msg)
+			}
+			var e *exprError
+			if !errors.As(err, &e) {
+				t.Fatalf("compileExpr() error = %v, want an *exprError", err)
+			}
+			if !strings.Contains(e.msg, tt.msg) {
+				t.Errorf("compileExpr() error = %q, want it to contain %q", e.msg, tt.msg)
+			}
+			if e.pos+1 != tt.column {
+				t.Errorf("compileExpr() column = %d, want %d", e.pos+1, tt.column)
+			}
+		})
+	}
+}
+
+func TestDescribeExprError(t *testing.T) {
+	expr := `"ü" == 1`
+	_, err := compileExpr(expr)
+	if err == nil {
+		t.Fatal("compileExpr() error = nil")
+	}
+
+	want := "column 5: can't compare string with number\n\t\"ü\" == 1\n\t    ^"
+	if got := describeExprError(expr, err); got != want {
+		t.Errorf("describeExprError() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/grafana/adaptive-metrics-autoapply/docker/internal"
+)
+
+// filtersConfig lists expressions that recommendations must satisfy to be adopted. See expr.go for the syntax.
+type filtersConfig struct {
+	Filters []filterConfig `json:"filters" yaml:"filters"`
+}
+
+type filterConfig struct {
+	Name       string `json:"name,omitempty" yaml:"name,omitempty"`
+	Expression string `json:"expression" yaml:"expression"`
+}
+
+type compiledFilter struct {
+	filterConfig
+	match func(rec internal.Recommendation) bool
+}
+
+func (f compiledFilter) String() string {
+	if f.Name != "" {
+		return f.Name
+	}
+	return f.Expression
+}
+
+func readFilters(file string) ([]compiledFilter, error) {
+	config, err := readConfigFile[filtersConfig](file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read filters: %w", err)
+	}
+
+	var filters []compiledFilter
+	for i, f := range config.Filters {
+		match, err := compileExpr(f.Expression)
+		if err != nil {
+			return nil, fmt.Errorf("invalid filter %d in %s: %s", i+1, file, describeExprError(f.Expression, err))
+		}
+		filters = append(filters, compiledFilter{filterConfig: f, match: match})
+	}
+	return filters, nil
+}
+
+// filterRejection records which filter rejected a recommendation.
+type filterRejection struct {
+	segment string
+	rec     internal.Recommendation
+	filter  compiledFilter
+}
+
+// applyFilters rejects the recommendations that change a rule and don't satisfy every filter. Rejected
+// recommendations keep the previous rule, or are left out if there is none.
+func applyFilters(filters []compiledFilter, segment internal.Segment, recs, oldRules []internal.Recommendation) ([]internal.Recommendation, []filterRejection) {
+	var kept []internal.Recommendation
+	var rejections []filterRejection
+	for _, rec := range recs {
+		rejected := false
+		if rec.RecommendedAction != "keep" {
+			for _, f := range filters {
+				if !f.match(rec) {
+					rejections = append(rejections, filterRejection{segment: segment.Name, rec: rec, filter: f})
+					rejected = true
+					break
+				}
+			}
+		}
+
+		if !rejected {
+			kept = append(kept, rec)
+		} else if previous, ok := keepPreviousRule(rec, oldRules); ok {
+			kept = append(kept, previous)
+		}
+	}
+	return kept, rejections
+}
+
+func writeFilterRejections(output io.Writer, rejections []filterRejection) {
+	if len(rejections) == 0 {
+		return
+	}
+
+	fmt.Fprintln(output, "## Filtered recommendations")
+	fmt.Fprintln(output, "| Segment | Metric | Action | Series Change | Rejected By |")
+	fmt.Fprintln(output, "|---------|--------|--------|---------------|-------------|")
+	for _, r := range rejections {
+		fmt.Fprintf(output, "| %s | %s | %s | %d | `%s` |\n", r.segment, r.rec.Metric, r.rec.RecommendedAction, r.rec.RecommendedSeriesCount-r.rec.CurrentSeriesCount, r.filter)
+	}
+}
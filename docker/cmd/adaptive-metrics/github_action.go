@@ -5,6 +5,8 @@ import (
 	"io"
 	"os"
 	"strings"
+
+	"github.com/grafana/adaptive-metrics-autoapply/docker/internal"
 )
 
 type githubActionWorkflowCommands struct {
@@ -61,3 +63,16 @@ func (c *githubActionWorkflowCommands) close() {
 	c.outputFile.Close()
 	c.summaryFile.Close()
 }
+
+// segmentOutputKeys returns the suffixes of the outputs of a segment: its ID, or default for the default segment, and
+// its name, which workflows read before outputs were keyed by ID. Only the ID is unambiguous, since a segment may be
+// named default, like the default segment, or have the same name as a deleted one.
+func segmentOutputKeys(segment internal.Segment) []string {
+	if segment == internal.DefaultSegment {
+		return []string{internal.DefaultSegmentName}
+	}
+	if segment.Name == segment.Identifier {
+		return []string{segment.Identifier}
+	}
+	return []string{segment.Identifier, segment.Name}
+}
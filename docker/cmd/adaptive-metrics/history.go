@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/grafana/adaptive-metrics-autoapply/docker/internal"
+)
+
+const historyFileSuffix = ".ndjson.gz"
+
+// historyRecord is the snapshot of a metric's recommendation at the time of a pull. The history store keeps one
+// gzipped NDJSON file per day, and every pull appends a gzip member with its records to the file of its day.
+type historyRecord struct {
+	Time               time.Time `json:"time"`
+	Segment            string    `json:"segment"`
+	Metric             string    `json:"metric"`
+	MatchType          string    `json:"match_type"`
+	Action             string    `json:"action,omitempty"`
+	RawSeries          int       `json:"raw_series"`
+	CurrentSeries      int       `json:"current_series"`
+	RecommendedSeries  int       `json:"recommended_series"`
+	UsagesInRules      int       `json:"usages_in_rules,omitempty"`
+	UsagesInQueries    int       `json:"usages_in_queries,omitempty"`
+	UsagesInDashboards int       `json:"usages_in_dashboards,omitempty"`
+	// RuleHash identifies the recommended rule, to tell when the recommendation changes.
+	RuleHash string `json:"rule_hash"`
+}
+
+func (r historyRecord) key() string {
+	return r.Segment + "\x00" + r.MatchType + "\x00" + r.Metric
+}
+
+// recommendedRule identifies the rule the recommendation ends up with, which is none for a removal.
+func (r historyRecord) recommendedRule() string {
+	if r.Action == "remove" {
+		return ""
+	}
+	return r.RuleHash
+}
+
+func newHistoryRecords(now time.Time, segment internal.Segment, recs []internal.Recommendation) ([]historyRecord, error) {
+	records := make([]historyRecord, 0, len(recs))
+	for _, rec := range recs {
+		rule, err := json.Marshal(rec.RuleData)
+		if err != nil {
+			return nil, err
+		}
+		h := fnv.New64a()
+		_, _ = h.Write(rule)
+
+		records = append(records, historyRecord{
+			Time:               now,
+			Segment:            segment.Name,
+			Metric:             rec.Metric,
+			MatchType:          matchTypeOf(rec),
+			Action:             rec.RecommendedAction,
+			RawSeries:          rec.RawSeriesCount,
+			CurrentSeries:      rec.CurrentSeriesCount,
+			RecommendedSeries:  rec.RecommendedSeriesCount,
+			UsagesInRules:      rec.UsagesInRules,
+			UsagesInQueries:    rec.UsagesInQueries,
+			UsagesInDashboards: rec.UsagesInDashboards,
+			RuleHash:           fmt.Sprintf("%016x", h.Sum64()),
+		})
+	}
+	return records, nil
+}
+
+func historyFileName(historyDir string, t time.Time) string {
+	return filepath.Join(historyDir, t.UTC().Format(time.DateOnly)+historyFileSuffix)
+}
+
+// appendHistory returns the content of the day's history file at path in dir with the records appended.
+func appendHistory(dir, path string, records []historyRecord) ([]byte, error) {
+	existing, err := os.ReadFile(filepath.Join(dir, path))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	buf := bytes.NewBuffer(existing)
+	zw := gzip.NewWriter(buf)
+	enc := json.NewEncoder(zw)
+	for _, r := range records {
+		if err := enc.Encode(r); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// readHistory reads the records of the history files in dir from since onwards, ordered by time.
+func readHistory(dir string, since time.Time) ([]historyRecord, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []historyRecord
+	for _, e := range entries {
+		day, ok := strings.CutSuffix(e.Name(), historyFileSuffix)
+		if !ok || e.IsDir() {
+			continue
+		}
+		if t, err := time.Parse(time.DateOnly, day); err == nil && t.AddDate(0, 0, 1).Before(since) {
+			continue
+		}
+
+		fileRecords, err := readHistoryFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", e.Name(), err)
+		}
+		for _, r := range fileRecords {
+			if !r.Time.Before(since) {
+				records = append(records, r)
+			}
+		}
+	}
+
+	slices.SortStableFunc(records, func(a, b historyRecord) int {
+		return a.Time.Compare(b.Time)
+	})
+	return records, nil
+}
+
+func readHistoryFile(path string) ([]historyRecord, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = file.Close() }()
+
+	// The gzip reader reads all members of the file, one per pull.
+	zr, err := gzip.NewReader(bufio.NewReader(file))
+	if err != nil {
+		return nil, err
+	}
+
+	var records []historyRecord
+	dec := json.NewDecoder(zr)
+	for {
+		var r historyRecord
+		err := dec.Decode(&r)
+		if errors.Is(err, io.EOF) {
+			return records, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+}
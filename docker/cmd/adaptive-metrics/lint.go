@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/grafana/adaptive-metrics-autoapply/docker/internal"
+)
+
+// lint checks the rule files and configs in the working directory without contacting the API.
+func lint(args []string) {
+	flags := flag.NewFlagSet("lint", flag.ExitOnError)
+	cfg := loadConfig(flags, args)
+	workingDir := flags.String("working-dir", cfg.get(settingWorkingDir), "The path to the working directory.")
+	exemptionsFile := flags.String("exemptions-file", cfg.get(settingExemptionsFile), "Optionally check the exemptions in this JSON or YAML file.")
+	filtersFile := flags.String("filters-file", cfg.get(settingFiltersFile), "Optionally check the filter expressions in this JSON or YAML file.")
+	budgetFile := flags.String("budget-file", cfg.get(settingBudgetFile), "Optionally check the series targets in this JSON or YAML file.")
+	protectedLabelsFile := flags.String("protected-labels-file", cfg.get(settingProtectedLabelsFile), "Optionally check the protected labels in this JSON or YAML file.")
+
+	err := flags.Parse(args)
+	if err != nil {
+		log.Fatalf("failed to parse flags: %v", err)
+	}
+
+	var problems, warnings []string
+
+	// The segments as of the last pull, since lint doesn't contact the API.
+	var segments []internal.Segment
+	manifest, err := readSegmentManifest(*workingDir)
+	if err != nil {
+		problems = append(problems, err.Error())
+	}
+	if manifest != nil {
+		for _, entry := range manifest.Segments {
+			segment := internal.Segment{Identifier: entry.ID, Name: entry.Name}
+			segments = append(segments, segment)
+			files, err := manifest.segmentFiles(*workingDir, segment)
+			if errors.Is(err, os.ErrNotExist) {
+				warnings = append(warnings, fmt.Sprintf("segment %q has no rule file", entry.Name))
+				continue
+			}
+			if err == nil {
+				_, err = mergeRuleFiles(files)
+			}
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("segment %q: %v", entry.Name, err))
+			}
+		}
+	} else {
+		for _, ext := range ruleFileExtensions {
+			files, err := filepath.Glob(filepath.Join(*workingDir, "recommendations*"+ext))
+			if err != nil {
+				log.Fatalf("failed to look for rule files: %v", err)
+			}
+			for _, file := range files {
+				if _, err := mergeRuleFiles([]string{file}); err != nil {
+					problems = append(problems, err.Error())
+				}
+			}
+		}
+	}
+
+	if *exemptionsFile != "" {
+		exemptions, err := readExemptions(*exemptionsFile)
+		if err != nil {
+			problems = append(problems, err.Error())
+		} else {
+			expiring, expired := exemptions.expiring(time.Now().UTC())
+			for _, e := range expiring {
+				warnings = append(warnings, fmt.Sprintf("the exemption of %s expires on %s, ask %s whether it's still needed", e, e.Until, e.Owner))
+			}
+			for _, e := range expired {
+				warnings = append(warnings, fmt.Sprintf("the exemption of %s expired on %s, remove it", e, e.Until))
+			}
+		}
+	}
+
+	if *filtersFile != "" {
+		if _, err := readFilters(*filtersFile); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	if *budgetFile != "" {
+		budget, err := readBudgetConfig(*budgetFile)
+		if err != nil {
+			problems = append(problems, err.Error())
+		} else if manifest != nil {
+			warnings = append(warnings, budget.unknownSegments(segments)...)
+		}
+	}
+
+	if *protectedLabelsFile != "" {
+		protected, err := readProtectedLabels(*protectedLabelsFile)
+		if err != nil {
+			problems = append(problems, err.Error())
+		} else if manifest != nil {
+			warnings = append(warnings, protected.unknownSegments(segments)...)
+		}
+	}
+
+	output := new(strings.Builder)
+	for _, w := range warnings {
+		log.Printf("warning: %s", w)
+		fmt.Fprintf(output, "- :warning: %s\n", w)
+	}
+	for _, p := range problems {
+		log.Printf("error: %s", p)
+		fmt.Fprintf(output, "- :x: %s\n", strings.ReplaceAll(p, "\n", " "))
+	}
+
+	gha, err := newGithubActionWorkflowCommands()
+	if err != nil {
+		log.Fatalf("failed to create GitHub Actions commands: %v", err)
+	}
+	defer gha.close()
+
+	if output.Len() > 0 {
+		err = gha.writeStepSummary("## Lint\n" + output.String())
+		if err != nil {
+			log.Fatalf("failed to write step summary: %v", err)
+		}
+	}
+
+	if len(problems) > 0 {
+		gha.close()
+		log.Fatalf("found %d problems", len(problems))
+	}
+	log.Printf("no problems found, %d warnings", len(warnings))
+}
@@ -2,12 +2,15 @@ package main
 
 import (
 	"log"
+	"net/http"
 	"os"
+
+	"github.com/grafana/adaptive-metrics-autoapply/docker/internal"
 )
 
 func main() {
 	if len(os.Args) < 2 {
-		log.Fatalf("missing command, available commands: pull, apply")
+		log.Fatalf("missing command, available commands: pull, apply, plan, status, lint, explain, doctor, export, report, plugin, config")
 	}
 
 	switch os.Args[1] {
@@ -15,7 +18,32 @@ func main() {
 		pull(os.Args[2:])
 	case "apply":
 		apply(os.Args[2:])
+	case "plan":
+		plan(os.Args[2:])
+	case "status":
+		status(os.Args[2:])
+	case "lint":
+		lint(os.Args[2:])
+	case "explain":
+		explain(os.Args[2:])
+	case "doctor":
+		doctor(os.Args[2:])
+	case "export":
+		export(os.Args[2:])
+	case "report":
+		report(os.Args[2:])
+	case "plugin":
+		plugin(os.Args[2:])
+	case "config":
+		configCommand(os.Args[2:])
 	default:
-		log.Fatalf("unknown command %s, available commands: pull, apply", os.Args[1])
+		log.Fatalf("unknown command %s, available commands: pull, apply, plan, status, lint, explain, doctor, export, report, plugin, config", os.Args[1])
 	}
 }
+
+func newClient(cfg *config, userAgent string) *internal.Client {
+	apiURL := cfg.mustGet(settingAPIURL)
+	apiKey := cfg.mustGet(settingAPIKey)
+
+	return internal.NewClient(&http.Client{}, userAgent, apiURL, apiKey)
+}
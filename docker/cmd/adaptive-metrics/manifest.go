@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/grafana/adaptive-metrics-autoapply/docker/internal"
+)
+
+const manifestFilename = "manifest.json"
+
+// segmentManifest maps segments to their rule files by identifier, so that files stay put when a segment is
+// renamed. The default segment has no identifier, which no other segment can share.
+type segmentManifest struct {
+	Layout   ruleFileLayout  `json:"layout,omitempty"`
+	Segments []manifestEntry `json:"segments"`
+}
+
+// manifestEntry points to the file pull writes the segment's rules to. In the directory layout, the rules are
+// read from every rule file in Dir instead.
+type manifestEntry struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	File string `json:"file"`
+	Dir  string `json:"dir,omitempty"`
+}
+
+type ruleFileLayout string
+
+const (
+	layoutFlat      ruleFileLayout = "flat"
+	layoutDirectory ruleFileLayout = "directory"
+
+	segmentsDirName     = "segments"
+	recommendedFileStem = "recommended"
+)
+
+func parseRuleFileLayout(s string) (ruleFileLayout, error) {
+	switch ruleFileLayout(s) {
+	case layoutFlat, layoutDirectory:
+		return ruleFileLayout(s), nil
+	default:
+		return "", fmt.Errorf("unknown layout %q, must be one of: flat, directory", s)
+	}
+}
+
+// stem returns the flat file name of the segment without extension, which directory names are derived from too.
+func (e manifestEntry) stem() string {
+	if e.Dir == "" {
+		return strings.TrimSuffix(e.File, filepath.Ext(e.File))
+	}
+	if e.ID == "" {
+		return "recommendations"
+	}
+	return "recommendations-" + path.Base(e.Dir)
+}
+
+func segmentDirName(stem string) string {
+	if stem == "recommendations" {
+		return internal.DefaultSegmentName
+	}
+	return strings.TrimPrefix(stem, "recommendations-")
+}
+
+type segmentRename struct {
+	oldName, newName, file string
+}
+
+// readSegmentManifest reads the manifest from dir. It returns nil if there is none yet.
+func readSegmentManifest(dir string) (*segmentManifest, error) {
+	m, err := readJSONFile[segmentManifest](filepath.Join(dir, manifestFilename))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", manifestFilename, err)
+	}
+	return &m, nil
+}
+
+func (m *segmentManifest) lookup(segment internal.Segment) (manifestEntry, bool) {
+	if m == nil {
+		return manifestEntry{}, false
+	}
+	for _, entry := range m.Segments {
+		if entry.ID == segment.Identifier {
+			return entry, true
+		}
+	}
+	return manifestEntry{}, false
+}
+
+// previousRuleFile returns the path of the file in dir that pull wrote the segment's rules to before, or an empty
+// string if there is none.
+func previousRuleFile(dir string, m *segmentManifest, segment internal.Segment) string {
+	if m == nil {
+		file, err := findSegmentFile(dir, segment)
+		if err != nil {
+			return ""
+		}
+		return file
+	}
+
+	entry, ok := m.lookup(segment)
+	if !ok {
+		return ""
+	}
+	path := filepath.Join(dir, entry.File)
+	if _, err := os.Stat(path); err != nil {
+		return ""
+	}
+	return path
+}
+
+// segmentFiles returns the paths of the segment's rule files in dir, in the order their rules are merged. Without a
+// manifest, it falls back to the file named after the segment. It returns an os.ErrNotExist error if the segment has
+// no rule file.
+func (m *segmentManifest) segmentFiles(dir string, segment internal.Segment) ([]string, error) {
+	if m == nil {
+		file, err := findSegmentFile(dir, segment)
+		if err != nil {
+			return nil, err
+		}
+		return []string{file}, nil
+	}
+
+	entry, ok := m.lookup(segment)
+	if !ok {
+		return nil, fmt.Errorf("segment %q isn't in %s, pull to add it: %w", segment.Name, manifestFilename, os.ErrNotExist)
+	}
+
+	if entry.Dir != "" {
+		files, err := ruleFilesInDir(filepath.Join(dir, entry.Dir))
+		if err == nil && len(files) == 0 {
+			err = fmt.Errorf("no rule files in %s: %w", entry.Dir, os.ErrNotExist)
+		}
+		return files, err
+	}
+
+	path := filepath.Join(dir, entry.File)
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	return []string{path}, nil
+}
+
+// stem returns the segment's file name without extension, for naming files derived from its rules.
+func (m *segmentManifest) stem(segment internal.Segment) string {
+	if entry, ok := m.lookup(segment); ok {
+		return entry.stem()
+	}
+	return sanitizedSegmentStem(segment)
+}
+
+// ruleFilesInDir returns the rule files in dir sorted by name. A missing directory has no rule files.
+func ruleFilesInDir(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, e := range entries {
+		if !e.IsDir() && slices.Contains(ruleFileExtensions, strings.ToLower(filepath.Ext(e.Name()))) {
+			files = append(files, filepath.Join(dir, e.Name()))
+		}
+	}
+	return files, nil
+}
+
+// resolve assigns a rule file to each segment and returns the updated manifest. Segments keep the file they
+// already have, in the requested format and layout if one is given. New segments adopt the file they had before the
+// manifest was introduced, or get a new one named after the segment. It also returns the files replaced by a file in
+// another format or layout, and the segments whose name changed.
+func (m *segmentManifest) resolve(dir string, segments []internal.Segment, format ruleFileFormat, layout ruleFileLayout) (*segmentManifest, []string, []segmentRename, error) {
+	resolved := &segmentManifest{Layout: layout}
+	if layout == "" && m != nil {
+		resolved.Layout = m.Layout
+	}
+
+	var replaced []string
+	var renames []segmentRename
+
+	taken := map[string]bool{}
+	stems := make([]string, len(segments))
+	formats := make([]ruleFileFormat, len(segments))
+	existing := make([]manifestEntry, len(segments))
+
+	// Existing segments first, so that new segments can't take their file names.
+	for i, segment := range segments {
+		entry, ok := m.lookup(segment)
+		if !ok {
+			continue
+		}
+
+		existing[i] = entry
+		stems[i] = entry.stem()
+		formats[i] = formatFromPath(entry.File)
+		taken[strings.ToLower(stems[i])] = true
+	}
+
+	for i, segment := range segments {
+		if stems[i] != "" {
+			continue
+		}
+
+		stems[i] = sanitizedSegmentStem(segment)
+		if taken[strings.ToLower(stems[i])] {
+			stems[i] += "-" + strings.ToLower(segment.Identifier)
+		}
+		taken[strings.ToLower(stems[i])] = true
+		formats[i] = formatJSON
+
+		if m == nil {
+			// Adopt the file written before manifests existed, as long as its name is a safe one.
+			legacy, err := findSegmentFile(dir, segment)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return nil, nil, nil, err
+			}
+			if legacy != "" && segmentFileStem(segment) == stems[i] {
+				existing[i] = manifestEntry{File: filepath.Base(legacy)}
+				formats[i] = formatFromPath(legacy)
+			}
+		}
+	}
+
+	for i, segment := range segments {
+		if format != "" {
+			formats[i] = format
+		}
+
+		entry := manifestEntry{
+			ID:   segment.Identifier,
+			Name: segment.Name,
+			File: stems[i] + formats[i].extension(),
+		}
+		if resolved.Layout == layoutDirectory {
+			entry.Dir = filepath.ToSlash(filepath.Join(segmentsDirName, segmentDirName(stems[i])))
+			entry.File = entry.Dir + "/" + recommendedFileStem + formats[i].extension()
+		}
+
+		old := existing[i]
+		if old.Dir != "" && entry.Dir == "" {
+			// Going back to a single file would lose the rules split out into other files.
+			files, err := ruleFilesInDir(filepath.Join(dir, old.Dir))
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			for _, f := range files {
+				if stem := strings.TrimSuffix(filepath.Base(f), filepath.Ext(f)); stem != recommendedFileStem {
+					return nil, nil, nil, fmt.Errorf("can't switch segment %q to the flat layout, %s has rules in other files than %s", segment.Name, old.Dir, recommendedFileStem)
+				}
+			}
+		}
+		if old.File != "" && old.File != entry.File {
+			replaced = append(replaced, old.File)
+		}
+		if old.Name != "" && old.Name != segment.Name {
+			renames = append(renames, segmentRename{oldName: old.Name, newName: segment.Name, file: entry.File})
+		}
+
+		resolved.Segments = append(resolved.Segments, entry)
+	}
+
+	return resolved, replaced, renames, nil
+}
+
+func (m *segmentManifest) marshal() ([]byte, error) {
+	return json.MarshalIndent(m, "", "  ")
+}
+
+var unsafeFilenameChars = regexp.MustCompile(`[^\p{L}\p{N}._-]+`)
+
+// sanitizedSegmentStem derives a file name from the segment name that is valid on any file system. A segment that
+// is literally named "default" gets its identifier appended, so it can never be mistaken for the default segment.
+func sanitizedSegmentStem(segment internal.Segment) string {
+	if segment == internal.DefaultSegment {
+		return "recommendations"
+	}
+
+	name := strings.Trim(unsafeFilenameChars.ReplaceAllString(segment.Name, "-"), "-.")
+	if name == "" || strings.EqualFold(name, internal.DefaultSegmentName) {
+		name = strings.Trim(name+"-"+strings.ToLower(segment.Identifier), "-")
+	}
+	return "recommendations-" + name
+}
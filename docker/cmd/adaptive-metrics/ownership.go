@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/grafana/adaptive-metrics-autoapply/docker/internal"
+)
+
+const unownedTeam = "unowned"
+
+// ownershipConfig assigns metrics to teams. A metric belongs to the first team with a matching metric pattern, or
+// else to the first team that owns its segment.
+type ownershipConfig struct {
+	Teams []teamOwnership `json:"teams" yaml:"teams"`
+}
+
+type teamOwnership struct {
+	Name string `json:"name" yaml:"name"`
+	// Metrics are glob patterns matched against metric names, for example "kube_*".
+	Metrics  []string `json:"metrics,omitempty" yaml:"metrics,omitempty"`
+	Segments []string `json:"segments,omitempty" yaml:"segments,omitempty"`
+
+	// Reviewers are GitHub users, and TeamReviewers GitHub team slugs, to request reviews from.
+	Reviewers     []string `json:"reviewers,omitempty" yaml:"reviewers,omitempty"`
+	TeamReviewers []string `json:"team_reviewers,omitempty" yaml:"team_reviewers,omitempty"`
+}
+
+func readOwnershipConfig(file string) (*ownershipConfig, error) {
+	o, err := readConfigFile[ownershipConfig](file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ownership config: %w", err)
+	}
+
+	for _, team := range o.Teams {
+		if team.Name == "" {
+			return nil, fmt.Errorf("invalid ownership config: every team needs a name")
+		}
+		for _, pattern := range team.Metrics {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid ownership config: bad metric pattern %q of team %s: %w", pattern, team.Name, err)
+			}
+		}
+	}
+	return &o, nil
+}
+
+// owner returns the team owning the metric in the given segment, or nil if nobody does.
+func (o *ownershipConfig) owner(segment internal.Segment, metric string) *teamOwnership {
+	for i, team := range o.Teams {
+		for _, pattern := range team.Metrics {
+			if ok, _ := path.Match(pattern, metric); ok {
+				return &o.Teams[i]
+			}
+		}
+	}
+	for i, team := range o.Teams {
+		if slices.Contains(team.Segments, segment.Name) {
+			return &o.Teams[i]
+		}
+	}
+	return nil
+}
+
+// teamReport sums up the recommendations of a team across segments.
+type teamReport struct {
+	Team               string `json:"team"`
+	Rules              int    `json:"rules"`
+	ChangedRules       int    `json:"changed_rules"`
+	CurrentSeries      int    `json:"current_series"`
+	SeriesChange       int    `json:"series_change"`
+	UsagesInRules      int    `json:"usages_in_rules"`
+	UsagesInQueries    int    `json:"usages_in_queries"`
+	UsagesInDashboards int    `json:"usages_in_dashboards"`
+
+	owner *teamOwnership
+}
+
+type teamReports struct {
+	ownership *ownershipConfig
+	reports   []*teamReport
+}
+
+func newTeamReports(ownership *ownershipConfig) *teamReports {
+	return &teamReports{ownership: ownership}
+}
+
+func (r *teamReports) report(owner *teamOwnership) *teamReport {
+	name := unownedTeam
+	if owner != nil {
+		name = owner.Name
+	}
+	for _, report := range r.reports {
+		if report.Team == name {
+			return report
+		}
+	}
+	report := &teamReport{Team: name, owner: owner}
+	r.reports = append(r.reports, report)
+	return report
+}
+
+// add attributes the recommendations of a segment to their teams.
+func (r *teamReports) add(segment internal.Segment, recs []internal.Recommendation) {
+	for _, rec := range recs {
+		report := r.report(r.ownership.owner(segment, rec.Metric))
+		if rec.RecommendedAction != "remove" {
+			report.Rules++
+		}
+		report.CurrentSeries += rec.CurrentSeriesCount
+		report.UsagesInRules += rec.UsagesInRules
+		report.UsagesInQueries += rec.UsagesInQueries
+		report.UsagesInDashboards += rec.UsagesInDashboards
+		if rec.RecommendedAction != "keep" {
+			report.ChangedRules++
+			report.SeriesChange += rec.RecommendedSeriesCount - rec.CurrentSeriesCount
+		}
+	}
+}
+
+// sorted returns the reports with the biggest series reduction first.
+func (r *teamReports) sorted() []*teamReport {
+	reports := slices.Clone(r.reports)
+	slices.SortStableFunc(reports, func(a, b *teamReport) int {
+		if a.SeriesChange != b.SeriesChange {
+			return a.SeriesChange - b.SeriesChange
+		}
+		return strings.Compare(a.Team, b.Team)
+	})
+	return reports
+}
+
+func (r *teamReports) write(output io.Writer) {
+	fmt.Fprintln(output, "## Changes per team")
+	fmt.Fprintln(output, "| Team | Rules | Changed Rules | Current Series | Series Change | Used in Rules | Used in Queries | Used in Dashboards |")
+	fmt.Fprintln(output, "|------|-------|---------------|----------------|---------------|---------------|-----------------|--------------------|")
+	for _, t := range r.sorted() {
+		fmt.Fprintf(output, "| %s | %d | %d | %d | %d | %d | %d | %d |\n", t.Team, t.Rules, t.ChangedRules, t.CurrentSeries, t.SeriesChange, t.UsagesInRules, t.UsagesInQueries, t.UsagesInDashboards)
+	}
+}
+
+func (r *teamReports) writeFile(path string) error {
+	reports := r.sorted()
+	if reports == nil {
+		reports = []*teamReport{}
+	}
+	out, err := json.MarshalIndent(struct {
+		Teams []*teamReport `json:"teams"`
+	}{reports}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, out, 0644)
+}
+
+// suggestedReviewers returns the reviewers and team reviewers of the teams with changed rules.
+func (r *teamReports) suggestedReviewers() (reviewers, teamReviewers []string) {
+	for _, report := range r.sorted() {
+		if report.owner == nil || report.ChangedRules == 0 {
+			continue
+		}
+		for _, reviewer := range report.owner.Reviewers {
+			if !slices.Contains(reviewers, reviewer) {
+				reviewers = append(reviewers, reviewer)
+			}
+		}
+		for _, team := range report.owner.TeamReviewers {
+			if !slices.Contains(teamReviewers, team) {
+				teamReviewers = append(teamReviewers, team)
+			}
+		}
+	}
+	return reviewers, teamReviewers
+}
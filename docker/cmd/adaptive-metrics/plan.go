@@ -0,0 +1,6 @@
+package main
+
+// plan shows the changes apply would make, without applying them.
+func plan(args []string) {
+	runApply("plan", args, true)
+}
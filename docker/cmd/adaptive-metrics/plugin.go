@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/grafana/adaptive-metrics-autoapply/docker/internal"
+)
+
+// pluginProtocolVersion is the version of the JSON messages exchanged with plugins. It changes whenever a message
+// changes in a way that older plugins can't handle.
+const pluginProtocolVersion = 1
+
+const defaultPluginTimeout = 30 * time.Second
+
+// pluginWaitDelay is how long to wait for the output of a plugin to be closed after it exited or was killed.
+const pluginWaitDelay = 5 * time.Second
+
+type pluginStage string
+
+const (
+	stagePull  pluginStage = "pull"
+	stageApply pluginStage = "apply"
+)
+
+type pluginsConfig struct {
+	Plugins []pluginConfig `json:"plugins" yaml:"plugins"`
+}
+
+// pluginConfig configures an executable that decides on the rules of each segment. It receives a pluginRequest on
+// stdin and must write a pluginResponse to stdout.
+type pluginConfig struct {
+	Name    string         `json:"name" yaml:"name"`
+	Command []string       `json:"command" yaml:"command"`
+	Timeout model.Duration `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+	// Stages limits the plugin to pull or apply. It runs for both by default.
+	Stages []pluginStage `json:"stages,omitempty" yaml:"stages,omitempty"`
+}
+
+type pluginRequest struct {
+	Version int              `json:"version"`
+	Stage   pluginStage      `json:"stage"`
+	Segment internal.Segment `json:"segment"`
+	// Recommendations are the verbose recommendations of the segment, sent on pull.
+	Recommendations []internal.Recommendation `json:"recommendations,omitempty"`
+	// Rules and Changes are the rules about to be applied and how they differ from the current ones, sent on apply.
+	Rules   []internal.Recommendation `json:"rules,omitempty"`
+	Changes []ruleChange              `json:"changes,omitempty"`
+}
+
+type pluginResponse struct {
+	Version   int              `json:"version"`
+	Decisions []pluginDecision `json:"decisions"`
+}
+
+type pluginDecisionType string
+
+const (
+	decisionAccept pluginDecisionType = "accept"
+	decisionReject pluginDecisionType = "reject"
+	decisionModify pluginDecisionType = "modify"
+)
+
+// pluginDecision is a plugin's verdict on the rule with the given metric and match type. Rules without a decision
+// are accepted. A modify decision replaces the rule with Rule.
+type pluginDecision struct {
+	Metric    string             `json:"metric"`
+	MatchType string             `json:"match_type,omitempty"`
+	Decision  pluginDecisionType `json:"decision"`
+	Reason    string             `json:"reason,omitempty"`
+	Rule      *internal.RuleData `json:"rule,omitempty"`
+
+	plugin  string
+	segment string
+}
+
+func (d pluginDecision) key() string {
+	return ruleKey(internal.Recommendation{RuleData: internal.RuleData{Metric: d.Metric, MatchType: d.MatchType}})
+}
+
+func readPluginsConfig(file string) (*pluginsConfig, error) {
+	p, err := readConfigFile[pluginsConfig](file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read plugins config: %w", err)
+	}
+
+	for _, plugin := range p.Plugins {
+		if plugin.Name == "" || len(plugin.Command) == 0 {
+			return nil, fmt.Errorf("invalid plugins config: every plugin needs a name and a command")
+		}
+		for _, stage := range plugin.Stages {
+			if stage != stagePull && stage != stageApply {
+				return nil, fmt.Errorf("invalid plugins config: unknown stage %q of plugin %s, must be one of: pull, apply", stage, plugin.Name)
+			}
+		}
+	}
+	return &p, nil
+}
+
+func (p *pluginsConfig) lookup(name string) (pluginConfig, bool) {
+	for _, plugin := range p.Plugins {
+		if plugin.Name == name {
+			return plugin, true
+		}
+	}
+	return pluginConfig{}, false
+}
+
+func (p pluginConfig) runsIn(stage pluginStage) bool {
+	return len(p.Stages) == 0 || slices.Contains(p.Stages, stage)
+}
+
+// run sends the request to the plugin and validates its response against the rules in the request.
+func (p pluginConfig) run(req pluginRequest) ([]pluginDecision, error) {
+	timeout := time.Duration(p.Timeout)
+	if timeout == 0 {
+		timeout = defaultPluginTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req.Version = pluginProtocolVersion
+	input, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	cmd := exec.CommandContext(ctx, p.Command[0], p.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	// The timeout only kills the plugin itself. Stop waiting for its output shortly after, in case a subprocess of the
+	// plugin keeps stdout or stderr open.
+	cmd.WaitDelay = pluginWaitDelay
+
+	err = cmd.Run()
+	if errors.Is(err, exec.ErrWaitDelay) {
+		// The plugin itself exited successfully, so its response is complete.
+		log.Printf("plugin %s exited, but a subprocess kept its output open for more than %s", p.Name, pluginWaitDelay)
+		err = nil
+	} else if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return nil, fmt.Errorf("plugin %s timed out after %s", p.Name, timeout)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("plugin %s failed: %w: %s", p.Name, err, strings.TrimSpace(stderr.String()))
+	}
+
+	var resp pluginResponse
+	if err := json.Unmarshal(stdout.Bytes(), &resp); err != nil {
+		return nil, fmt.Errorf("plugin %s returned an invalid response: %w", p.Name, err)
+	}
+	if resp.Version != pluginProtocolVersion {
+		return nil, fmt.Errorf("plugin %s speaks protocol version %d, expected %d", p.Name, resp.Version, pluginProtocolVersion)
+	}
+
+	sent := map[string]bool{}
+	for _, r := range req.Recommendations {
+		sent[ruleKey(r)] = true
+	}
+	for _, r := range req.Rules {
+		sent[ruleKey(r)] = true
+	}
+	// On apply, the changes also list the rules about to be removed, which plugins may reject to keep them.
+	removed := map[string]bool{}
+	for _, c := range req.Changes {
+		if key := c.key(); !sent[key] {
+			removed[key] = true
+		}
+	}
+	for i, d := range resp.Decisions {
+		if !sent[d.key()] && !removed[d.key()] {
+			return nil, fmt.Errorf("plugin %s decided on %s, which isn't one of the rules it was sent", p.Name, d.key())
+		}
+		switch d.Decision {
+		case decisionAccept, decisionReject:
+		case decisionModify:
+			if removed[d.key()] {
+				return nil, fmt.Errorf("plugin %s modified %s, which is being removed, reject the removal instead to keep the current rule", p.Name, d.key())
+			}
+			if d.Rule == nil || d.Rule.Metric != d.Metric || matchTypeOf(internal.Recommendation{RuleData: *d.Rule}) != matchTypeOf(internal.Recommendation{RuleData: internal.RuleData{MatchType: d.MatchType}}) {
+				return nil, fmt.Errorf("plugin %s modified %s without returning a rule with the same metric and match type", p.Name, d.key())
+			}
+		default:
+			return nil, fmt.Errorf("plugin %s returned unknown decision %q for %s", p.Name, d.Decision, d.key())
+		}
+		resp.Decisions[i].plugin = p.Name
+		resp.Decisions[i].segment = req.Segment.Name
+	}
+	return resp.Decisions, nil
+}
+
+// runPlugins runs the plugins of the stage one after another, each on the rules left by the previous one. It returns
+// the rules after applying all decisions, and the decisions themselves. previous returns the rule to fall back to when
+// a rule is rejected, or false if the rule should be left out.
+func (p *pluginsConfig) runPlugins(stage pluginStage, segment internal.Segment, rules []internal.Recommendation, changes func([]internal.Recommendation) []ruleChange, previous func(internal.Recommendation) (internal.Recommendation, bool)) ([]internal.Recommendation, []pluginDecision, error) {
+	var all []pluginDecision
+	for _, plugin := range p.Plugins {
+		if !plugin.runsIn(stage) {
+			continue
+		}
+
+		req := pluginRequest{Stage: stage, Segment: segment}
+		if stage == stagePull {
+			req.Recommendations = rules
+		} else {
+			req.Rules = rules
+			req.Changes = changes(rules)
+		}
+
+		decisions, err := plugin.run(req)
+		if err != nil {
+			return nil, nil, err
+		}
+		rules = applyPluginDecisions(rules, decisions, previous)
+		all = append(all, decisions...)
+	}
+	return rules, all, nil
+}
+
+// applyPluginDecisions returns the rules with the decisions applied. A rejected rule falls back to previous, which on
+// apply also brings back a rule whose removal was rejected.
+func applyPluginDecisions(rules []internal.Recommendation, decisions []pluginDecision, previous func(internal.Recommendation) (internal.Recommendation, bool)) []internal.Recommendation {
+	var result []internal.Recommendation
+	for _, rule := range rules {
+		i := slices.IndexFunc(decisions, func(d pluginDecision) bool { return d.key() == ruleKey(rule) })
+		switch {
+		case i < 0 || decisions[i].Decision == decisionAccept:
+			result = append(result, rule)
+		case decisions[i].Decision == decisionModify:
+			rule.RuleData = *decisions[i].Rule
+			result = append(result, rule)
+		default:
+			if prev, ok := previous(rule); ok {
+				result = append(result, prev)
+			}
+		}
+	}
+
+	for _, d := range decisions {
+		if d.Decision != decisionReject || slices.ContainsFunc(rules, func(r internal.Recommendation) bool { return ruleKey(r) == d.key() }) {
+			continue
+		}
+		if prev, ok := previous(internal.Recommendation{RuleData: internal.RuleData{Metric: d.Metric, MatchType: d.MatchType}}); ok {
+			result = append(result, prev)
+		}
+	}
+	return result
+}
+
+// writePluginDecisions lists the decisions other than accept, with their reasons.
+func writePluginDecisions(output io.Writer, stage pluginStage, decisions []pluginDecision) {
+	var notable []pluginDecision
+	modified := false
+	for _, d := range decisions {
+		if d.Decision != decisionAccept {
+			notable = append(notable, d)
+		}
+		modified = modified || d.Decision == decisionModify
+	}
+	if len(notable) == 0 {
+		return
+	}
+
+	fmt.Fprintln(output, "## Plugin decisions")
+	if stage == stagePull && modified {
+		fmt.Fprintln(output, "Modified recommendations keep the series counts of the original recommendation, so their series change is approximate:")
+	}
+	fmt.Fprintln(output, "| Plugin | Segment | Metric | Match Type | Decision | Reason |")
+	fmt.Fprintln(output, "|--------|---------|--------|------------|----------|--------|")
+	for _, d := range notable {
+		fmt.Fprintf(output, "| %s | %s | %s | %s | %s | %s |\n", d.plugin, d.segment, d.Metric, matchTypeOf(internal.Recommendation{RuleData: internal.RuleData{MatchType: d.MatchType}}), d.Decision, d.Reason)
+	}
+}
+
+func plugin(args []string) {
+	if len(args) < 1 {
+		log.Fatalf("missing plugin command, available commands: test")
+	}
+
+	switch args[0] {
+	case "test":
+		pluginTest(args[1:])
+	default:
+		log.Fatalf("unknown plugin command %s, available commands: test", args[0])
+	}
+}
+
+// pluginTest runs a plugin on a rule file, so that plugins can be developed without pulling or applying.
+func pluginTest(args []string) {
+	flags := flag.NewFlagSet("plugin test", flag.ExitOnError)
+	cfg := loadConfig(flags, args)
+	pluginsFile := flags.String("plugins-file", cfg.get(settingPluginsFile), "The plugins config, in JSON or YAML.")
+	name := flags.String("name", "", "The name of the plugin to run.")
+	stage := flags.String("stage", string(stagePull), "The stage to run the plugin for: pull or apply.")
+	input := flags.String("input", "", "A rule file with the recommendations (pull) or rules (apply) to send to the plugin.")
+	segmentName := flags.String("segment", internal.DefaultSegmentName, "The name of the segment to send to the plugin.")
+
+	err := flags.Parse(args)
+	if err != nil {
+		log.Fatalf("failed to parse flags: %v", err)
+	}
+	if *pluginsFile == "" || *name == "" || *input == "" {
+		log.Fatalf("-plugins-file, -name and -input are required")
+	}
+
+	plugins, err := readPluginsConfig(*pluginsFile)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	p, ok := plugins.lookup(*name)
+	if !ok {
+		log.Fatalf("no plugin named %s in %s", *name, *pluginsFile)
+	}
+
+	rules, err := readRulesFile(*input)
+	if err != nil {
+		log.Fatalf("failed to read %s: %v", *input, err)
+	}
+
+	segment := internal.Segment{Name: *segmentName}
+	if segment.Name == internal.DefaultSegmentName {
+		segment = internal.DefaultSegment
+	}
+	req := pluginRequest{Stage: pluginStage(*stage), Segment: segment}
+	switch req.Stage {
+	case stagePull:
+		req.Recommendations = rules
+	case stageApply:
+		req.Rules = rules
+		req.Changes = diffRules(segment, nil, rules)
+	default:
+		log.Fatalf("unknown stage %q, must be one of: pull, apply", *stage)
+	}
+
+	decisions, err := p.run(req)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	log.Printf("plugin %s returned a valid response with %d decisions", p.Name, len(decisions))
+	for _, d := range decisions {
+		fmt.Printf("%s\t%s\t%s", d.Decision, d.key(), d.Reason)
+		if d.Rule != nil {
+			fmt.Printf("\t%s", formatDiffValue(d.Rule))
+		}
+		fmt.Println()
+	}
+}
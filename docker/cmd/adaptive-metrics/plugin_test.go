@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/grafana/adaptive-metrics-autoapply/docker/internal"
+)
+
+// TestPluginHelperProcess isn't a real test. It's run as a plugin by the tests below, and responds with the decisions
+// in PLUGIN_DECISIONS.
+func TestPluginHelperProcess(t *testing.T) {
+	decisions := os.Getenv("PLUGIN_DECISIONS")
+	if decisions == "" {
+		return
+	}
+	if _, err := io.Copy(io.Discard, os.Stdin); err != nil {
+		os.Exit(1)
+	}
+	fmt.Printf(`{"version": %d, "decisions": %s}`, pluginProtocolVersion, decisions)
+	os.Exit(0)
+}
+
+func testPlugin(t *testing.T, decisions string) *pluginsConfig {
+	t.Helper()
+	t.Setenv("PLUGIN_DECISIONS", decisions)
+	return &pluginsConfig{Plugins: []pluginConfig{{
+		Name:    "test",
+		Command: []string{os.Args[0], "-test.run=^TestPluginHelperProcess$"},
+	}}}
+}
+
+// runApplyPlugins runs the plugins like apply does, with the rules read from the files and the current remote rules.
+func runApplyPlugins(plugins *pluginsConfig, rules, current []internal.Recommendation) ([]internal.Recommendation, []pluginDecision, error) {
+	segment := internal.DefaultSegment
+	changes := func(rules []internal.Recommendation) []ruleChange {
+		return diffRules(segment, current, rules)
+	}
+	currentRule := func(rule internal.Recommendation) (internal.Recommendation, bool) {
+		i := slices.IndexFunc(current, func(r internal.Recommendation) bool { return ruleKey(r) == ruleKey(rule) })
+		if i < 0 {
+			return internal.Recommendation{}, false
+		}
+		return current[i], true
+	}
+	return plugins.runPlugins(stageApply, segment, rules, changes, currentRule)
+}
+
+func TestApplyPluginRejectsRemoval(t *testing.T) {
+	current := []internal.Recommendation{
+		{RuleData: internal.RuleData{Metric: "kept", Drop: true}},
+		{RuleData: internal.RuleData{Metric: "removed", DropLabels: []string{"pod"}}},
+	}
+	rules := []internal.Recommendation{
+		{RuleData: internal.RuleData{Metric: "kept", Drop: true}},
+	}
+	plugins := testPlugin(t, `[{"metric": "removed", "decision": "reject", "reason": "still needed"}]`)
+
+	got, decisions, err := runApplyPlugins(plugins, rules, current)
+	if err != nil {
+		t.Fatalf("runPlugins() error = %v", err)
+	}
+	if diff := cmp.Diff(current, got); diff != "" {
+		t.Errorf("rules mismatch (-want +got):\n%s", diff)
+	}
+	if len(decisions) != 1 || decisions[0].Decision != decisionReject || decisions[0].Metric != "removed" {
+		t.Errorf("decisions = %+v, want the rejected removal", decisions)
+	}
+}
+
+func TestApplyPluginDecisionErrors(t *testing.T) {
+	current := []internal.Recommendation{
+		{RuleData: internal.RuleData{Metric: "removed", DropLabels: []string{"pod"}}},
+	}
+	rules := []internal.Recommendation{
+		{RuleData: internal.RuleData{Metric: "added", Drop: true}},
+	}
+
+	tests := []struct {
+		name      string
+		decisions string
+		err       string
+	}{
+		{
+			name:      "unknown rule",
+			decisions: `[{"metric": "unknown", "decision": "reject"}]`,
+			err:       "isn't one of the rules it was sent",
+		},
+		{
+			name:      "modified removal",
+			decisions: `[{"metric": "removed", "decision": "modify", "rule": {"metric": "removed", "drop": true}}]`,
+			err:       "which is being removed",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := runApplyPlugins(testPlugin(t, tt.decisions), rules, current)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("runPlugins() error = %v, want it to contain %q", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// pricingConfig describes what active series cost per month. Series covered by a commitment are paid for with its
+// flat price. The remaining series are priced by the tiers if there are any, or at the flat rate otherwise.
+type pricingConfig struct {
+	Currency         string         `json:"currency" yaml:"currency"`
+	PricePer1kSeries float64        `json:"price_per_1k_series" yaml:"price_per_1k_series"`
+	Committed        *committedRate `json:"committed,omitempty" yaml:"committed,omitempty"`
+	Tiers            []pricingTier  `json:"tiers,omitempty" yaml:"tiers,omitempty"`
+}
+
+// committedRate is a monthly price that covers a fixed number of series, whether they are used or not.
+type committedRate struct {
+	Series       int     `json:"series" yaml:"series"`
+	MonthlyPrice float64 `json:"monthly_price" yaml:"monthly_price"`
+}
+
+// pricingTier prices the series from the end of the previous tier up to UpTo. UpTo is an absolute number of series
+// beyond the commitment, not the size of the tier. The last tier may leave UpTo unset to cover all remaining series.
+type pricingTier struct {
+	UpTo             int     `json:"up_to,omitempty" yaml:"up_to,omitempty"`
+	PricePer1kSeries float64 `json:"price_per_1k_series" yaml:"price_per_1k_series"`
+}
+
+func readPricingConfig(path string) (*pricingConfig, error) {
+	p, err := readConfigFile[pricingConfig](path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pricing config: %w", err)
+	}
+
+	last := 0
+	for i, tier := range p.Tiers {
+		if tier.UpTo == 0 && i != len(p.Tiers)-1 {
+			return nil, fmt.Errorf("invalid pricing config: only the last tier can leave up_to unset")
+		}
+		if tier.UpTo != 0 && tier.UpTo <= last {
+			return nil, fmt.Errorf("invalid pricing config: up_to of the tiers must be increasing")
+		}
+		last = tier.UpTo
+	}
+	return &p, nil
+}
+
+// monthlyCost returns the estimated monthly cost of the given number of active series.
+func (p *pricingConfig) monthlyCost(series int) float64 {
+	var cost float64
+	if p.Committed != nil {
+		cost += p.Committed.MonthlyPrice
+		series = max(series-p.Committed.Series, 0)
+	}
+
+	if len(p.Tiers) == 0 {
+		return cost + float64(series)/1000*p.PricePer1kSeries
+	}
+
+	start := 0
+	for _, tier := range p.Tiers {
+		if series <= start {
+			break
+		}
+		end := series
+		if tier.UpTo != 0 {
+			end = min(series, tier.UpTo)
+		}
+		cost += float64(end-start) / 1000 * tier.PricePer1kSeries
+		start = end
+	}
+	// Series beyond the last tier are priced at the flat rate.
+	if series > start {
+		cost += float64(series-start) / 1000 * p.PricePer1kSeries
+	}
+	return cost
+}
+
+func (p *pricingConfig) format(cost float64) string {
+	s := strconv.FormatFloat(cost, 'f', 2, 64)
+	if p.Currency != "" {
+		s += " " + p.Currency
+	}
+	return s
+}
+
+// seriesEstimate is the number of active series of a segment before and after a change.
+type seriesEstimate struct {
+	segment       string
+	before, after int
+}
+
+// costEstimate prices the series of all segments together, since tiers and commitments apply to the whole stack.
+// Each segment's share of the cost is proportional to its series.
+type costEstimate struct {
+	pricing   *pricingConfig
+	estimates []seriesEstimate
+
+	before, after float64
+}
+
+func newCostEstimate(pricing *pricingConfig, estimates []seriesEstimate) costEstimate {
+	totalBefore, totalAfter := 0, 0
+	for _, e := range estimates {
+		totalBefore += e.before
+		totalAfter += e.after
+	}
+	return costEstimate{
+		pricing:   pricing,
+		estimates: estimates,
+		before:    pricing.monthlyCost(totalBefore),
+		after:     pricing.monthlyCost(totalAfter),
+	}
+}
+
+func (c costEstimate) savings() float64 {
+	return c.before - c.after
+}
+
+func (c costEstimate) share(series, total int, cost float64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return cost * float64(series) / float64(total)
+}
+
+func (c costEstimate) write(output io.Writer) {
+	totalBefore, totalAfter := 0, 0
+	for _, e := range c.estimates {
+		totalBefore += e.before
+		totalAfter += e.after
+	}
+
+	fmt.Fprintln(output, "#### Estimated monthly cost")
+	fmt.Fprintln(output, "| Segment | Series Before | Series After | Cost Before | Cost After | Savings |")
+	fmt.Fprintln(output, "|---------|---------------|--------------|-------------|------------|---------|")
+	for _, e := range c.estimates {
+		before := c.share(e.before, totalBefore, c.before)
+		after := c.share(e.after, totalAfter, c.after)
+		fmt.Fprintf(output, "| %s | %d | %d | %s | %s | %s |\n", e.segment, e.before, e.after, c.pricing.format(before), c.pricing.format(after), c.pricing.format(before-after))
+	}
+	fmt.Fprintf(output, "| **Total** | %d | %d | %s | %s | %s |\n", totalBefore, totalAfter, c.pricing.format(c.before), c.pricing.format(c.after), c.pricing.format(c.savings()))
+}
+
+func (c costEstimate) writeOutputs(gha *githubActionWorkflowCommands) error {
+	outputs := []struct {
+		name  string
+		value float64
+	}{
+		{"estimated-cost-before", c.before},
+		{"estimated-cost-after", c.after},
+		{"estimated-savings", c.savings()},
+	}
+	for _, o := range outputs {
+		if err := gha.writeOutput(o.name, strconv.FormatFloat(o.value, 'f', 2, 64)); err != nil {
+			return err
+		}
+	}
+	return gha.writeOutput("currency", c.pricing.Currency)
+}
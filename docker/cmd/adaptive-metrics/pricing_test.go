@@ -0,0 +1,73 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestMonthlyCost(t *testing.T) {
+	flat := pricingConfig{PricePer1kSeries: 8}
+	committed := pricingConfig{
+		PricePer1kSeries: 10,
+		Committed:        &committedRate{Series: 10_000, MonthlyPrice: 50},
+	}
+	tiered := pricingConfig{
+		PricePer1kSeries: 1,
+		Tiers: []pricingTier{
+			{UpTo: 10_000, PricePer1kSeries: 8},
+			{UpTo: 50_000, PricePer1kSeries: 4},
+		},
+	}
+	unbounded := pricingConfig{
+		PricePer1kSeries: 100,
+		Tiers: []pricingTier{
+			{UpTo: 10_000, PricePer1kSeries: 8},
+			{PricePer1kSeries: 2},
+		},
+	}
+	committedTiered := pricingConfig{
+		PricePer1kSeries: 1,
+		Committed:        &committedRate{Series: 5_000, MonthlyPrice: 20},
+		Tiers: []pricingTier{
+			{UpTo: 10_000, PricePer1kSeries: 8},
+			{PricePer1kSeries: 4},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		pricing pricingConfig
+		series  int
+		want    float64
+	}{
+		{"flat rate", flat, 2_500, 20},
+		{"flat rate without series", flat, 0, 0},
+
+		// The committed price is paid even for series that aren't used.
+		{"committed below the committed series", committed, 4_000, 50},
+		{"committed at the committed series", committed, 10_000, 50},
+		{"committed above the committed series", committed, 12_000, 70},
+		{"committed without series", committed, 0, 50},
+
+		{"tiers within the first tier", tiered, 5_000, 40},
+		{"tiers at the end of the first tier", tiered, 10_000, 80},
+		{"tiers spanning tiers", tiered, 30_000, 80 + 80},
+		{"tiers at the end of the last tier", tiered, 50_000, 80 + 160},
+		// Series beyond the last bounded tier fall back to the flat rate.
+		{"tiers beyond the last tier", tiered, 60_000, 80 + 160 + 10},
+
+		{"unbounded last tier", unbounded, 60_000, 80 + 100},
+
+		// The committed series are taken off first, the rest goes through the tiers from the first one.
+		{"committed and tiers within the committed series", committedTiered, 5_000, 20},
+		{"committed and tiers within the first tier", committedTiered, 10_000, 20 + 40},
+		{"committed and tiers spanning tiers", committedTiered, 25_000, 20 + 80 + 40},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.pricing.monthlyCost(tt.series); math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("monthlyCost(%d) = %v, want %v", tt.series, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/grafana/adaptive-metrics-autoapply/docker/internal"
+)
+
+// protectedLabelsConfig lists labels that rules must never aggregate away, in all segments or in one segment.
+type protectedLabelsConfig struct {
+	Labels   []string                 `json:"labels,omitempty" yaml:"labels,omitempty"`
+	Segments []segmentProtectedLabels `json:"segments,omitempty" yaml:"segments,omitempty"`
+}
+
+// segmentProtectedLabels are the labels protected in one segment, by name or, to survive renames, by ID.
+type segmentProtectedLabels struct {
+	Segment string   `json:"segment,omitempty" yaml:"segment,omitempty"`
+	ID      string   `json:"id,omitempty" yaml:"id,omitempty"`
+	Labels  []string `json:"labels" yaml:"labels"`
+}
+
+func readProtectedLabels(file string) (*protectedLabelsConfig, error) {
+	p, err := readConfigFile[protectedLabelsConfig](file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read protected labels: %w", err)
+	}
+
+	for _, s := range p.Segments {
+		if s.Segment == "" && s.ID == "" {
+			return nil, fmt.Errorf("invalid protected labels in %s: segment or id is required", file)
+		}
+	}
+	return &p, nil
+}
+
+// labels returns the labels protected in the segment.
+func (p *protectedLabelsConfig) labels(segment internal.Segment) []string {
+	labels := slices.Clone(p.Labels)
+	for _, s := range p.Segments {
+		if matchesSegment(s.Segment, s.ID, segment) {
+			labels = append(labels, s.Labels...)
+		}
+	}
+	slices.Sort(labels)
+	return slices.Compact(labels)
+}
+
+// unknownSegments describes the segment entries that match none of the segments, for example after a rename.
+func (p *protectedLabelsConfig) unknownSegments(segments []internal.Segment) []string {
+	var unknown []string
+	for _, s := range p.Segments {
+		if !slices.ContainsFunc(segments, func(segment internal.Segment) bool { return matchesSegment(s.Segment, s.ID, segment) }) {
+			unknown = append(unknown, fmt.Sprintf("the protected labels of segment %s don't match any segment, so they aren't protected there", describeSegmentRef(s.Segment, s.ID)))
+		}
+	}
+	return unknown
+}
+
+// droppedLabels returns the protected labels that the rule aggregates away. Dropping the whole metric doesn't
+// aggregate anything, so it's allowed.
+func droppedLabels(rule internal.RuleData, protected []string) []string {
+	var dropped []string
+	for _, label := range protected {
+		if slices.Contains(rule.DropLabels, label) || (len(rule.KeepLabels) > 0 && !slices.Contains(rule.KeepLabels, label)) {
+			dropped = append(dropped, label)
+		}
+	}
+	return dropped
+}
+
+// protectedRewrite records a recommendation that was modified to keep protected labels, and what became of it.
+type protectedRewrite struct {
+	segment string
+	rec     internal.Recommendation
+	labels  []string
+	result  string
+}
+
+const (
+	protectedRewritten = "rewritten"
+	protectedRemoved   = "removed"
+	protectedLeftOut   = "left out"
+)
+
+// protectRecommendations rewrites the recommendations that would aggregate away protected labels, so that they keep
+// them instead. A rule that is left with no labels to aggregate away and no aggregations of its own is removed if it
+// exists, and left out otherwise. The series counts of rewritten recommendations no longer match the rule, so
+// they're only an approximation.
+func (p *protectedLabelsConfig) protectRecommendations(segment internal.Segment, recs []internal.Recommendation) ([]internal.Recommendation, []protectedRewrite) {
+	protected := p.labels(segment)
+	var kept []internal.Recommendation
+	var rewrites []protectedRewrite
+	for _, rec := range recs {
+		dropped := droppedLabels(rec.RuleData, protected)
+		if rec.RecommendedAction == "remove" || len(dropped) == 0 {
+			kept = append(kept, rec)
+			continue
+		}
+
+		rewritten := rec
+		rewritten.DropLabels = slices.DeleteFunc(slices.Clone(rec.DropLabels), func(label string) bool { return slices.Contains(dropped, label) })
+		if len(rec.KeepLabels) > 0 {
+			rewritten.KeepLabels = append(slices.Clone(rec.KeepLabels), dropped...)
+		}
+
+		rewrite := protectedRewrite{segment: segment.Name, rec: rec, labels: dropped, result: protectedRewritten}
+		switch {
+		case len(rewritten.DropLabels) > 0 || len(rewritten.KeepLabels) > 0 || rewritten.Drop ||
+			len(rewritten.Aggregations) > 0 || rewritten.AggregationInterval != 0:
+			// The existing rule changes too, if it dropped protected labels.
+			if rewritten.RecommendedAction == "keep" {
+				rewritten.RecommendedAction = "update"
+			}
+			kept = append(kept, rewritten)
+		case rec.RecommendedAction == "add":
+			rewrite.result = protectedLeftOut
+		default:
+			// The existing rule only aggregated away protected labels, so nothing of it can be kept.
+			rewrite.result = protectedRemoved
+			rewritten.RecommendedAction = "remove"
+			rewritten.RecommendedSeriesCount = rec.RawSeriesCount
+			kept = append(kept, rewritten)
+		}
+		rewrites = append(rewrites, rewrite)
+	}
+	return kept, rewrites
+}
+
+// checkProtectedLabels fails if any of the rules aggregates away a label protected in the segment.
+func (p *protectedLabelsConfig) checkProtectedLabels(segment internal.Segment, rules []internal.Recommendation) error {
+	protected := p.labels(segment)
+	var violations []string
+	for _, rule := range rules {
+		if dropped := droppedLabels(rule.RuleData, protected); len(dropped) > 0 {
+			violations = append(violations, fmt.Sprintf("metric %q with match type %s drops %s", rule.Metric, matchTypeOf(rule), strings.Join(dropped, ", ")))
+		}
+	}
+	if len(violations) > 0 {
+		return fmt.Errorf("rules aggregate away protected labels, %s", strings.Join(violations, "; "))
+	}
+	return nil
+}
+
+func writeProtectedRewrites(output io.Writer, rewrites []protectedRewrite) {
+	if len(rewrites) == 0 {
+		return
+	}
+
+	fmt.Fprintln(output, "## Protected labels")
+	fmt.Fprintln(output, "These recommendations were modified to keep protected labels, so their series change is approximate:")
+	fmt.Fprintln(output, "| Segment | Metric | Action | Kept Labels | Result |")
+	fmt.Fprintln(output, "|---------|--------|--------|-------------|--------|")
+	for _, r := range rewrites {
+		fmt.Fprintf(output, "| %s | %s | %s | %s | %s |\n", r.segment, r.rec.Metric, r.rec.RecommendedAction, strings.Join(r.labels, ", "), r.result)
+	}
+}
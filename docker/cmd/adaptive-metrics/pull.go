@@ -6,37 +6,150 @@ import (
 	"fmt"
 	"io"
 	"log"
-	"net/http"
 	"os"
 	"path/filepath"
 	"slices"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
 
 	"github.com/grafana/adaptive-metrics-autoapply/docker/internal"
 )
 
 func pull(args []string) {
-	defaultWorkingDir := "./"
-	if workingDirEnvVar := os.Getenv("INPUT_WORKING-DIR"); workingDirEnvVar != "" {
-		defaultWorkingDir = workingDirEnvVar
-	}
-
 	flags := flag.NewFlagSet("pull", flag.ExitOnError)
-	workingDir := flags.String("working-dir", defaultWorkingDir, "The path to the working directory.")
-	userAgent := flags.String("user-agent", "gh-action-autoapply", "The user-agent to use when making requests against the API.")
-	writeSegments := flags.Bool("write-segments", false, "Optionally write a segments.json file to disk.")
+	cfg := loadConfig(flags, args)
+	workingDir := flags.String("working-dir", cfg.get(settingWorkingDir), "The path to the working directory.")
+	userAgent := flags.String("user-agent", cfg.get(settingUserAgent), "The user-agent to use when making requests against the API.")
+	writeSegments := flags.Bool("write-segments", cfg.getBool(settingWriteSegments), "Optionally write a segments.json file to disk.")
+	formatFlag := flags.String("format", cfg.get(settingFormat), "The format of the rule files to write, json or yaml. Defaults to the format of the existing file for each segment, or json.")
+	layoutFlag := flags.String("layout", cfg.get(settingLayout), "The layout of the rule files, flat or directory. Defaults to the layout recorded in the manifest, or flat.")
+	deleteOrphans := flags.Bool("delete-orphans", cfg.getBool(settingDeleteOrphans), "Delete rule files of segments that no longer exist, instead of only reporting them.")
+	diffFile := flags.String("diff-file", cfg.get(settingDiffFile), "Optionally write the changes to the rule files as JSON to this file.")
+	pricingFile := flags.String("pricing-file", cfg.get(settingPricingFile), "Optionally estimate the monthly cost with the pricing config in this JSON or YAML file.")
+	ownershipFile := flags.String("ownership-file", cfg.get(settingOwnershipFile), "Optionally break the changes down per team with the ownership config in this JSON or YAML file.")
+	budgetFile := flags.String("budget-file", cfg.get(settingBudgetFile), "Optionally only adopt the recommendations needed to meet the series targets in this JSON or YAML file.")
+	riskFile := flags.String("risk-file", cfg.get(settingRiskFile), "Optionally score the risk of recommendations with the risk config in this JSON or YAML file, instead of the default one.")
+	maxRiskFlag := flags.String("max-risk", cfg.get(settingMaxRisk), "The highest risk level of recommendations that may be auto-merged: low, medium or high.")
+	exemptionsFile := flags.String("exemptions-file", cfg.get(settingExemptionsFile), "Optionally keep the rules of the metrics with an active exemption in this JSON or YAML file.")
+	filtersFile := flags.String("filters-file", cfg.get(settingFiltersFile), "Optionally only adopt the recommendations that satisfy the filter expressions in this JSON or YAML file.")
+	pluginsFile := flags.String("plugins-file", cfg.get(settingPluginsFile), "Optionally run the policy plugins configured in this JSON or YAML file on the recommendations.")
+	protectedLabelsFile := flags.String("protected-labels-file", cfg.get(settingProtectedLabelsFile), "Optionally rewrite the recommendations to keep the labels protected in this JSON or YAML file.")
+	historyDir := flags.String("history-dir", cfg.get(settingHistoryDir), "Optionally append a snapshot of the recommendations to the history store in this directory, relative to the working directory.")
+	cooldownFlag := flags.String("cooldown", cfg.get(settingCooldown), "Optionally don't add back rules removed less than this long ago, for example 14d.")
+	cooldownFile := flags.String("cooldown-file", cfg.get(settingCooldownFile), "The file to track rule removals in for -cooldown, relative to the working directory.")
+	teamReportFile := flags.String("team-report-file", cfg.get(settingTeamReportFile), "Optionally write the per-team breakdown as JSON to this file. Requires -ownership-file.")
 
 	err := flags.Parse(args)
 	if err != nil {
 		log.Fatalf("failed to parse flags: %v", err)
 	}
 
-	apiURL := mustGetEnv("GRAFANA_AM_API_URL")
-	apiKey := mustGetEnv("GRAFANA_AM_API_KEY")
+	var format ruleFileFormat
+	if *formatFlag != "" {
+		format, err = parseRuleFileFormat(*formatFlag)
+		if err != nil {
+			log.Fatalf("invalid -format: %v", err)
+		}
+	}
 
-	c := internal.NewClient(&http.Client{}, *userAgent, apiURL, apiKey)
+	var layout ruleFileLayout
+	if *layoutFlag != "" {
+		layout, err = parseRuleFileLayout(*layoutFlag)
+		if err != nil {
+			log.Fatalf("invalid -layout: %v", err)
+		}
+	}
+
+	var pricing *pricingConfig
+	if *pricingFile != "" {
+		pricing, err = readPricingConfig(*pricingFile)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+	}
+
+	maxRisk, err := parseRiskLevel(*maxRiskFlag)
+	if err != nil {
+		log.Fatalf("invalid -max-risk: %v", err)
+	}
+	risk := &defaultRiskConfig
+	if *riskFile != "" {
+		risk, err = readRiskConfig(*riskFile)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+	}
+
+	var cooldown time.Duration
+	var cooldowns *cooldownState
+	if *cooldownFlag != "" {
+		d, err := model.ParseDuration(*cooldownFlag)
+		if err != nil {
+			log.Fatalf("invalid -cooldown: %v", err)
+		}
+		cooldown = time.Duration(d)
+		cooldowns, err = readCooldownState(filepath.Join(*workingDir, *cooldownFile))
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+	}
+
+	var exemptions *exemptionsConfig
+	if *exemptionsFile != "" {
+		exemptions, err = readExemptions(*exemptionsFile)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+	}
+
+	var filters []compiledFilter
+	if *filtersFile != "" {
+		filters, err = readFilters(*filtersFile)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+	}
+
+	var plugins *pluginsConfig
+	if *pluginsFile != "" {
+		plugins, err = readPluginsConfig(*pluginsFile)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+	}
+
+	var protected *protectedLabelsConfig
+	if *protectedLabelsFile != "" {
+		protected, err = readProtectedLabels(*protectedLabelsFile)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+	}
+
+	var budget *budgetConfig
+	if *budgetFile != "" {
+		budget, err = readBudgetConfig(*budgetFile)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+	}
+
+	var teams *teamReports
+	if *ownershipFile != "" {
+		ownership, err := readOwnershipConfig(*ownershipFile)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		teams = newTeamReports(ownership)
+	} else if *teamReportFile != "" {
+		log.Fatalf("-team-report-file requires -ownership-file")
+	}
+
+	c := newClient(cfg, *userAgent)
 
 	// Fetch all segments.
 	segments, err := c.FetchSegments()
@@ -44,48 +157,102 @@ func pull(args []string) {
 		log.Fatalf("failed to fetch segments: %v", err)
 	}
 
+	// Stage all files, so that a failure for one segment doesn't leave a mix of old and new files behind.
+	tx, err := newFileTransaction(*workingDir)
+	if err != nil {
+		log.Fatalf("failed to create staging directory: %v", err)
+	}
+	fatalf := func(format string, v ...any) {
+		tx.rollback()
+		log.Fatalf(format, v...)
+	}
+
 	if *writeSegments {
 		log.Printf("writing segments.json with %d segments", len(segments))
-		err = writeJSONToFile(filepath.Join(*workingDir, "segments.json"), segments)
+		data, err := json.MarshalIndent(segments, "", "  ")
+		if err == nil {
+			err = tx.write("segments.json", data)
+		}
 		if err != nil {
-			log.Fatalf("failed to write segments.json: %v", err)
+			fatalf("failed to write segments.json: %v", err)
 		}
 	}
 
 	// Add the default segment.
 	segments = append(segments, internal.DefaultSegment)
 
+	var unknown []string
+	if budget != nil {
+		unknown = append(unknown, budget.unknownSegments(segments)...)
+	}
+	if protected != nil {
+		unknown = append(unknown, protected.unknownSegments(segments)...)
+	}
+	for _, u := range unknown {
+		log.Printf("warning: %s", u)
+	}
+
+	// Assign a file to each segment, keeping the format of the existing file unless one was requested.
+	previous, err := readSegmentManifest(*workingDir)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	manifest, replaced, renames, err := previous.resolve(*workingDir, segments, format, layout)
+	if err != nil {
+		fatalf("failed to assign files to segments: %v", err)
+	}
+	for _, r := range replaced {
+		log.Printf("replacing %s", r)
+		tx.remove(r)
+	}
+	data, err := manifest.marshal()
+	if err == nil {
+		err = tx.write(manifestFilename, data)
+	}
+	if err != nil {
+		fatalf("failed to write %s: %v", manifestFilename, err)
+	}
+
 	gha, err := newGithubActionWorkflowCommands()
 	if err != nil {
-		log.Fatalf("failed to create github action workflow commands: %v", err)
+		fatalf("failed to create github action workflow commands: %v", err)
 	}
 
 	totalSeriesChange := 0
 	totalSeries := 0
+	// Outputs are only written once the pulled files are in place, so that a failed pull publishes none of them.
+	var outputs []struct{ name, value string }
+	addOutput := func(name, value string) {
+		outputs = append(outputs, struct{ name, value string }{name, value})
+	}
+	var allChanges []segmentDiff
+	var seriesEstimates []seriesEstimate
+	var history []historyRecord
+	now := time.Now().UTC()
 	output := new(strings.Builder)
-	for _, segment := range segments {
+	writeRenames(output, renames)
+	// Fetch all recommendations first, since a budget may span segments.
+	segmentRecs := make([][]internal.Recommendation, len(segments))
+	otherRules := make([][]internal.Recommendation, len(segments))
+	oldRules := make([][]internal.Recommendation, len(segments))
+	var exempted []exemptedRecommendation
+	var suppressed []suppressedReAdd
+	var rejections []filterRejection
+	var decisions []pluginDecision
+	var rewrites []protectedRewrite
+	// The series change of recommendations modified by plugins or rewritten to keep protected labels is only approximate,
+	// since they keep the series counts of the original recommendation.
+	approximate := make([]map[string]bool, len(segments))
+	for i, segment := range segments {
+		approximate[i] = map[string]bool{}
 		// Fetch recommendations for each segment.
 		recs, err := c.FetchRecommendations(segment, true)
 		if err != nil {
-			log.Fatalf("failed to fetch recommendations for segment %s: %v", segment.Name, err)
+			fatalf("failed to fetch recommendations for segment %s: %v", segment.Name, err)
 		}
 
 		// Sort exact match rules first, then sort by metric name.
-		slices.SortStableFunc(recs, func(a, b internal.Recommendation) int {
-			// If both are exact matches, sort by metric name.
-			if isExactMatch(a) && isExactMatch(b) {
-				return strings.Compare(a.Metric, b.Metric)
-			}
-			// Otherwise sort exact matches first
-			if a.MatchType != b.MatchType {
-				if isExactMatch(a) {
-					return -1
-				}
-				return 1
-			}
-			// Otherwise don't change anything, since it may change the semantics of the ruleset.
-			return 0
-		})
+		slices.SortStableFunc(recs, compareRuleOrder)
 
 		// Strip the managed_by field from the recommendations. This adds unnecessary noise to the files, and is overwritten when applying the rules anyway.
 		for i, r := range recs {
@@ -93,35 +260,218 @@ func pull(args []string) {
 			recs[i] = r
 		}
 
-		// Write the recommendations to a file.
-		var filename string
-		if segment == internal.DefaultSegment {
-			filename = "recommendations.json"
-		} else {
-			filename = fmt.Sprintf("recommendations-%s.json", segment.Name)
+		if *historyDir != "" {
+			records, err := newHistoryRecords(now, segment, recs)
+			if err != nil {
+				fatalf("failed to record history for segment %s: %v", segment.Name, err)
+			}
+			history = append(history, records...)
 		}
-		log.Printf("writing recommendations for segment %s to %s with %d rules", segment.Name, filename, len(recs))
-		err = writeJSONToFile(filepath.Join(*workingDir, filename), internal.ConvertVerboseToRules(recs))
+
+		// In the directory layout, rules split out into other files take precedence over the recommendations.
+		if entry := manifest.Segments[i]; entry.Dir != "" {
+			recs, otherRules[i], err = withoutRulesInOtherFiles(*workingDir, entry, recs)
+			if err != nil {
+				fatalf("failed to read rules for segment %s: %v", segment.Name, err)
+			}
+		}
+
+		oldRules[i], err = readSegmentRules(*workingDir, previous, segment)
 		if err != nil {
-			log.Fatalf("failed to write recommendations for segment %s: %v", segment.Name, err)
+			log.Printf("failed to read the previous rules for segment %s, diffing against no rules: %v", segment.Name, err)
 		}
 
-		writeChanges(output, segment, recs)
+		if cooldowns != nil {
+			state := cooldowns.segment(segment)
+			state.recordDeletions(now, oldRules[i])
+			var segmentSuppressed []suppressedReAdd
+			recs, segmentSuppressed = state.suppressReAdds(now, cooldown, segment, recs, oldRules[i])
+			suppressed = append(suppressed, segmentSuppressed...)
+		}
 
-		segmentChange := seriesChangeForSegment(recs)
-		err = gha.writeOutput(fmt.Sprintf("series-change-%s", segment.Name), strconv.Itoa(segmentChange))
+		if exemptions != nil {
+			var segmentExempted []exemptedRecommendation
+			recs, segmentExempted = exemptions.exemptRecommendations(now, segment, recs, oldRules[i])
+			exempted = append(exempted, segmentExempted...)
+		}
+
+		if filters != nil {
+			var rejected []filterRejection
+			recs, rejected = applyFilters(filters, segment, recs, oldRules[i])
+			rejections = append(rejections, rejected...)
+		}
+
+		if plugins != nil {
+			previousRule := func(rec internal.Recommendation) (internal.Recommendation, bool) {
+				return keepPreviousRule(rec, oldRules[i])
+			}
+			var segmentDecisions []pluginDecision
+			recs, segmentDecisions, err = plugins.runPlugins(stagePull, segment, recs, nil, previousRule)
+			if err != nil {
+				fatalf("failed to run plugins for segment %s: %v", segment.Name, err)
+			}
+			for _, d := range segmentDecisions {
+				if d.Decision == decisionModify {
+					approximate[i][d.key()] = true
+				}
+			}
+			decisions = append(decisions, segmentDecisions...)
+		}
+
+		// Protected labels are enforced last, so that no other step can aggregate them away again.
+		if protected != nil {
+			var segmentRewrites []protectedRewrite
+			recs, segmentRewrites = protected.protectRecommendations(segment, recs)
+			for _, r := range segmentRewrites {
+				approximate[i][ruleKey(r.rec)] = true
+			}
+			rewrites = append(rewrites, segmentRewrites...)
+		}
+
+		segmentRecs[i] = recs
+	}
+
+	if exemptions != nil {
+		exemptions.logExpiring(now)
+		writeExemptions(output, now, exemptions, exempted)
+	}
+	writeSuppressedReAdds(output, suppressed)
+	writeFilterRejections(output, rejections)
+	writePluginDecisions(output, stagePull, decisions)
+	writeProtectedRewrites(output, rewrites)
+
+	if budget != nil {
+		selection := budget.selectRecommendations(segments, segmentRecs)
+		for i := range segments {
+			segmentRecs[i] = selection.deferRecommendations(i, segmentRecs[i], oldRules[i])
+		}
+		selection.write(output, segments)
+		addOutput("budget-met", strconv.FormatBool(selection.met()))
+	}
+
+	for i, segment := range segments {
+		recs := segmentRecs[i]
+		entry := manifest.Segments[i]
+
+		// Write the recommendations to the file assigned to the segment.
+		filename := entry.File
+		rules := internal.ConvertVerboseToRules(recs)
+		log.Printf("writing recommendations for segment %s to %s with %d rules", segment.Name, filename, len(recs))
+		previousFile := previousRuleFile(*workingDir, previous, segment)
+		if previousFile != "" && formatFromPath(previousFile) == formatYAML && formatFromPath(filename) != formatYAML {
+			log.Printf("any comments in %s are lost, since %s can't hold them", previousFile, filename)
+		}
+		data, err := marshalRules(filepath.Join(*workingDir, filename), previousFile, rules)
+		if err == nil {
+			err = tx.write(filename, data)
+		}
 		if err != nil {
-			log.Fatalf("failed to write series-change output for segment %s: %v", segment.Name, err)
+			fatalf("failed to write recommendations for segment %s: %v", segment.Name, err)
+		}
+
+		// Compare the rules the segment ends up with to the rules it had before the pull.
+		newRules := otherRules[i]
+		for _, rule := range rules {
+			newRules = append(newRules, internal.Recommendation{RuleData: rule})
+		}
+		allChanges = append(allChanges, diffSegment(segment, oldRules[i], newRules))
+		if cooldowns != nil {
+			cooldowns.segment(segment).update(now, cooldown, oldRules[i], newRules)
+		}
+
+		writeChanges(output, segment, recs, risk, approximate[i])
+		if teams != nil {
+			teams.add(segment, recs)
 		}
 
+		segmentChange := seriesChangeForSegment(recs)
 		segmentTotal := totalSeriesForSegment(recs)
-		err = gha.writeOutput(fmt.Sprintf("series-total-%s", segment.Name), strconv.Itoa(segmentTotal))
-		if err != nil {
-			log.Fatalf("failed to write series-total output for segment %s: %v", segment.Name, err)
+		for _, key := range segmentOutputKeys(segment) {
+			addOutput("series-change-"+key, strconv.Itoa(segmentChange))
+			addOutput("series-total-"+key, strconv.Itoa(segmentTotal))
 		}
 
 		totalSeriesChange += segmentChange
 		totalSeries += segmentTotal
+		seriesEstimates = append(seriesEstimates, seriesEstimate{segment: segment.Name, before: segmentTotal, after: segmentTotal + segmentChange})
+	}
+
+	// Recommendations above the maximum risk need a review, so they must not be merged automatically.
+	highest, found := riskLow, false
+	for _, recs := range segmentRecs {
+		if level, ok := highestRisk(recs, risk); ok {
+			highest, found = max(highest, level), true
+		}
+	}
+	autoMerge := !found || highest <= maxRisk
+	if !autoMerge {
+		fmt.Fprintf(output, "## Auto-merge disabled\nThere are %s risk recommendations, above the maximum risk of %s for auto-merge.\n", highest, maxRisk)
+	}
+	if found {
+		addOutput("risk", highest.String())
+	}
+	addOutput("auto-merge-allowed", strconv.FormatBool(autoMerge))
+
+	if *historyDir != "" {
+		filename := historyFileName(*historyDir, now)
+		log.Printf("appending %d records to %s", len(history), filename)
+		data, err := appendHistory(*workingDir, filename, history)
+		if err == nil {
+			err = tx.write(filename, data)
+		}
+		if err != nil {
+			fatalf("failed to write history: %v", err)
+		}
+	}
+
+	if cooldowns != nil {
+		cooldowns.prune(segments)
+		data, err := cooldowns.marshal()
+		if err == nil {
+			err = tx.write(*cooldownFile, data)
+		}
+		if err != nil {
+			fatalf("failed to write %s: %v", *cooldownFile, err)
+		}
+	}
+
+	pulled := func(name string) bool { return tx.written(name) || slices.Contains(tx.removals, name) }
+	orphans, err := findOrphanedRuleFiles(*workingDir, manifest, pulled)
+	if err != nil {
+		fatalf("failed to look for orphaned rule files: %v", err)
+	}
+	writeOrphans(output, orphans, *deleteOrphans)
+	for _, orphan := range orphans {
+		if *deleteOrphans {
+			log.Printf("deleting %s, its segment no longer exists", orphan)
+			tx.remove(orphan)
+		} else {
+			log.Printf("%s doesn't belong to any segment, delete it or run with -delete-orphans", orphan)
+		}
+	}
+
+	err = tx.commit()
+	if err != nil {
+		log.Fatalf("failed to move pulled files into place: %v", err)
+	}
+
+	for _, o := range outputs {
+		err = gha.writeOutput(o.name, o.value)
+		if err != nil {
+			log.Fatalf("failed to write %s output: %v", o.name, err)
+		}
+	}
+
+	if *diffFile != "" {
+		err = writeDiffFile(*diffFile, allChanges)
+		if err != nil {
+			log.Fatalf("failed to write diff file: %v", err)
+		}
+
+		err = gha.writeOutput("diff-file", *diffFile)
+		if err != nil {
+			log.Fatalf("failed to write diff-file output: %v", err)
+		}
 	}
 
 	err = gha.writeOutput("series-change", strconv.Itoa(totalSeriesChange))
@@ -134,12 +484,141 @@ func pull(args []string) {
 		log.Fatalf("failed to write series-total output: %v", err)
 	}
 
+	if teams != nil {
+		teams.write(output)
+
+		if *teamReportFile != "" {
+			err = teams.writeFile(*teamReportFile)
+			if err != nil {
+				log.Fatalf("failed to write team report: %v", err)
+			}
+		}
+
+		reviewers, teamReviewers := teams.suggestedReviewers()
+		err = gha.writeOutput("suggested-reviewers", strings.Join(reviewers, ","))
+		if err != nil {
+			log.Fatalf("failed to write suggested-reviewers output: %v", err)
+		}
+		err = gha.writeOutput("suggested-team-reviewers", strings.Join(teamReviewers, ","))
+		if err != nil {
+			log.Fatalf("failed to write suggested-team-reviewers output: %v", err)
+		}
+	}
+
+	if pricing != nil {
+		estimate := newCostEstimate(pricing, seriesEstimates)
+		estimate.write(output)
+
+		err = estimate.writeOutputs(gha)
+		if err != nil {
+			log.Fatalf("failed to write cost outputs: %v", err)
+		}
+	}
+
 	err = gha.writeStepSummary(output.String())
 	if err != nil {
 		log.Fatalf("failed to write step summary: %v", err)
 	}
 }
 
+// withoutRulesInOtherFiles drops the recommendations for rules defined in other files of the segment's directory.
+// It also returns the rules of those files.
+func withoutRulesInOtherFiles(workingDir string, entry manifestEntry, recs []internal.Recommendation) ([]internal.Recommendation, []internal.Recommendation, error) {
+	files, err := ruleFilesInDir(filepath.Join(workingDir, entry.Dir))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var others []string
+	for _, file := range files {
+		if stem := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file)); stem != recommendedFileStem {
+			others = append(others, file)
+		}
+	}
+	if len(others) == 0 {
+		return recs, nil, nil
+	}
+
+	rules, err := mergeRuleFiles(others)
+	if err != nil {
+		return nil, nil, err
+	}
+	defined := map[string]bool{}
+	for _, rule := range rules {
+		defined[ruleKey(rule)] = true
+	}
+
+	var kept []internal.Recommendation
+	for _, rec := range recs {
+		if defined[ruleKey(rec)] {
+			log.Printf("skipping recommendation for %s in %s, it's defined in another file", rec.Metric, entry.Dir)
+			continue
+		}
+		kept = append(kept, rec)
+	}
+	return kept, rules, nil
+}
+
+// findOrphanedRuleFiles returns the rule files in dir that don't belong to any segment according to owned, and the
+// segment directories that aren't in the manifest, because the segment they belonged to was removed.
+func findOrphanedRuleFiles(dir string, manifest *segmentManifest, owned func(name string) bool) ([]string, error) {
+	var orphans []string
+	for _, ext := range ruleFileExtensions {
+		matches, err := filepath.Glob(filepath.Join(dir, "recommendations*"+ext))
+		if err != nil {
+			return nil, err
+		}
+		for _, match := range matches {
+			name := filepath.Base(match)
+			if !owned(name) {
+				orphans = append(orphans, name)
+			}
+		}
+	}
+
+	dirs, err := os.ReadDir(filepath.Join(dir, segmentsDirName))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, d := range dirs {
+		name := segmentsDirName + "/" + d.Name()
+		if d.IsDir() && !slices.ContainsFunc(manifest.Segments, func(e manifestEntry) bool { return e.Dir == name }) {
+			orphans = append(orphans, name)
+		}
+	}
+
+	sort.Strings(orphans)
+	return orphans, nil
+}
+
+func writeRenames(output io.Writer, renames []segmentRename) {
+	if len(renames) == 0 {
+		return
+	}
+
+	fmt.Fprintf(output, "## Renamed segments\n")
+	for _, r := range renames {
+		log.Printf("segment %s was renamed to %s, keeping its rules in %s", r.oldName, r.newName, r.file)
+		fmt.Fprintf(output, "- %q was renamed to %q, its rules stay in `%s`\n", r.oldName, r.newName, r.file)
+	}
+}
+
+func writeOrphans(output io.Writer, orphans []string, deleted bool) {
+	if len(orphans) == 0 {
+		return
+	}
+
+	fmt.Fprintf(output, "## Orphaned rule files\n")
+	if deleted {
+		fmt.Fprintln(output, "The following files belonged to segments that no longer exist and were deleted:")
+	} else {
+		fmt.Fprintln(output, "The following files don't belong to any segment. Delete them, or pull with `delete-orphans` enabled:")
+	}
+	for _, orphan := range orphans {
+		fmt.Fprintf(output, "- `%s`\n", orphan)
+	}
+}
+
 func totalSeriesForSegment(recs []internal.Recommendation) int {
 	var total int
 	for _, rec := range recs {
@@ -159,11 +638,14 @@ func seriesChangeForSegment(recs []internal.Recommendation) int {
 	return total
 }
 
-func writeChanges(output io.Writer, segment internal.Segment, recs []internal.Recommendation) {
+// writeChanges writes the recommendations that change a rule, marking the series changes in approximate as such.
+func writeChanges(output io.Writer, segment internal.Segment, recs []internal.Recommendation, risk *riskConfig, approximate map[string]bool) {
 	type change struct {
 		seriesChange int
 		action       string
 		metric       string
+		rec          internal.Recommendation
+		score        float64
 	}
 
 	var changes []change
@@ -175,6 +657,8 @@ func writeChanges(output io.Writer, segment internal.Segment, recs []internal.Re
 			seriesChange: rec.RecommendedSeriesCount - rec.CurrentSeriesCount,
 			action:       rec.RecommendedAction,
 			metric:       rec.Metric,
+			rec:          rec,
+			score:        risk.score(rec),
 		})
 	}
 
@@ -189,42 +673,77 @@ func writeChanges(output io.Writer, segment internal.Segment, recs []internal.Re
 	fmt.Fprintf(output, "## Segment %q\n", segment.Name)
 
 	fmt.Fprintf(output, "### Series Change\n")
-	fmt.Fprintf(output, "Total series change: %d\n", seriesChangeForSegment(recs))
+	prefix := ""
+	if len(approximate) > 0 {
+		prefix = "~"
+	}
+	fmt.Fprintf(output, "Total series change: %s%d\n", prefix, seriesChangeForSegment(recs))
 	fmt.Fprintf(output, "Total series: %d\n", totalSeriesForSegment(recs))
 	fmt.Fprintf(output, "Percentage change: %.2f%%\n", float64(seriesChangeForSegment(recs))/float64(totalSeriesForSegment(recs))*100)
 
-	fmt.Fprintln(output, "| Metric | Action | Series Change |")
-	fmt.Fprintln(output, "|--------|--------|---------------|")
-	for _, c := range changes {
-		fmt.Fprintf(output, "| %s | %s | %d |\n", c.metric, c.action, c.seriesChange)
+	// Group the changes by risk, so the ones that need a closer look come first.
+	for _, level := range riskLevels {
+		var group []change
+		for _, c := range changes {
+			if risk.level(c.score) == level {
+				group = append(group, c)
+			}
+		}
+		if len(group) == 0 {
+			continue
+		}
+
+		fmt.Fprintf(output, "#### %s risk\n", strings.ToUpper(level.String()[:1])+level.String()[1:])
+		fmt.Fprintln(output, "| Metric | Action | Series Change | Used in Rules | Used in Queries | Used in Dashboards | Risk Score |")
+		fmt.Fprintln(output, "|--------|--------|---------------|---------------|-----------------|--------------------|------------|")
+		for _, c := range group {
+			prefix := ""
+			if approximate[ruleKey(c.rec)] {
+				prefix = "~"
+			}
+			fmt.Fprintf(output, "| %s | %s | %s%d | %d | %d | %d | %.1f |\n", c.metric, c.action, prefix, c.seriesChange, c.rec.UsagesInRules, c.rec.UsagesInQueries, c.rec.UsagesInDashboards, c.score)
+		}
 	}
 }
 
-func isExactMatch(rule internal.Recommendation) bool {
-	return rule.MatchType == "exact" || rule.MatchType == ""
+// highestRisk returns the highest risk level of the recommendations that change a rule.
+func highestRisk(recs []internal.Recommendation, risk *riskConfig) (riskLevel, bool) {
+	highest, found := riskLow, false
+	for _, rec := range recs {
+		if rec.RecommendedAction == "keep" {
+			continue
+		}
+		highest, found = max(highest, risk.level(risk.score(rec))), true
+	}
+	return highest, found
 }
 
-func mustGetEnv(key string) string {
-	val, ok := os.LookupEnv(key)
-	if !ok {
-		log.Fatalf("missing required env var %s", key)
+// compareRuleOrder orders exact match rules first, sorted by metric name. Other rules keep their relative order,
+// since changing it may change the semantics of the ruleset.
+func compareRuleOrder(a, b internal.Recommendation) int {
+	switch {
+	case isExactMatch(a) && isExactMatch(b):
+		return strings.Compare(a.Metric, b.Metric)
+	case isExactMatch(a):
+		return -1
+	case isExactMatch(b):
+		return 1
+	default:
+		return 0
 	}
-
-	return val
 }
 
-func writeJSONToFile(filePath string, obj any) error {
-	out, err := json.MarshalIndent(obj, "", "  ")
-	if err != nil {
-		return err
-	}
+func isExactMatch(rule internal.Recommendation) bool {
+	return rule.MatchType == "exact" || rule.MatchType == ""
+}
 
-	f, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
-	if err != nil {
-		return err
+func matchTypeOf(rule internal.Recommendation) string {
+	if isExactMatch(rule) {
+		return "exact"
 	}
-	defer func() { _ = f.Close() }()
+	return rule.MatchType
+}
 
-	_, err = f.Write(out)
-	return err
+func ruleKey(rule internal.Recommendation) string {
+	return matchTypeOf(rule) + "/" + rule.Metric
 }
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"cmp"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+func report(args []string) {
+	if len(args) < 1 {
+		log.Fatalf("missing report, available reports: trends")
+	}
+
+	switch args[0] {
+	case "trends":
+		reportTrends(args[1:])
+	default:
+		log.Fatalf("unknown report %s, available reports: trends", args[0])
+	}
+}
+
+func reportTrends(args []string) {
+	flags := flag.NewFlagSet("report trends", flag.ExitOnError)
+	cfg := loadConfig(flags, args)
+	workingDir := flags.String("working-dir", cfg.get(settingWorkingDir), "The path to the working directory.")
+	historyDir := flags.String("history-dir", cmp.Or(cfg.get(settingHistoryDir), "history"), "The directory of the history store, relative to the working directory.")
+	window := flags.String("since", "30d", "How far back to look, for example 30d or 12w.")
+	top := flags.Int("top", 10, "The number of metrics to list per table.")
+	minChanges := flags.Int("min-changes", 2, "How often a recommendation must change to be listed as unstable.")
+
+	err := flags.Parse(args)
+	if err != nil {
+		log.Fatalf("failed to parse flags: %v", err)
+	}
+
+	since, err := model.ParseDuration(*window)
+	if err != nil {
+		log.Fatalf("invalid -since: %v", err)
+	}
+
+	records, err := readHistory(filepath.Join(*workingDir, *historyDir), time.Now().Add(-time.Duration(since)))
+	if err != nil {
+		log.Fatalf("failed to read history: %v", err)
+	}
+	if len(records) == 0 {
+		log.Fatalf("no history in the last %s, run pull with -history-dir to record it", *window)
+	}
+
+	output := new(strings.Builder)
+	fmt.Fprintf(output, "## Trends since %s\n", records[0].Time.Format(time.DateOnly))
+	writeGrowth(output, records, *top)
+	writeRealisedSavings(output, records)
+	writeUnstableRecommendations(output, records, *top, *minChanges)
+
+	fmt.Print(output.String())
+
+	gha, err := newGithubActionWorkflowCommands()
+	if err != nil {
+		log.Fatalf("failed to create GitHub Actions commands: %v", err)
+	}
+	defer gha.close()
+
+	err = gha.writeStepSummary(output.String())
+	if err != nil {
+		log.Fatalf("failed to write step summary: %v", err)
+	}
+}
+
+// historySpan holds the first and last record of a metric, and how often its recommendation changed in between.
+type historySpan struct {
+	first, last historyRecord
+	changes     int
+}
+
+func historySpans(records []historyRecord) []*historySpan {
+	var spans []*historySpan
+	byKey := map[string]*historySpan{}
+	for _, r := range records {
+		span, ok := byKey[r.key()]
+		if !ok {
+			span = &historySpan{first: r, last: r}
+			byKey[r.key()] = span
+			spans = append(spans, span)
+			continue
+		}
+		// Only count changes of the rule the recommendation ends up with. The action alone changes without the rule
+		// changing, like an add turning into a keep once the recommendation is applied.
+		if r.recommendedRule() != span.last.recommendedRule() {
+			span.changes++
+		}
+		span.last = r
+	}
+	return spans
+}
+
+// writeGrowth lists the metrics whose raw series grew the most between their first and last snapshot.
+func writeGrowth(output io.Writer, records []historyRecord, top int) {
+	var growing []*historySpan
+	for _, span := range historySpans(records) {
+		if span.last.RawSeries > span.first.RawSeries {
+			growing = append(growing, span)
+		}
+	}
+	slices.SortStableFunc(growing, func(a, b *historySpan) int {
+		return (b.last.RawSeries - b.first.RawSeries) - (a.last.RawSeries - a.first.RawSeries)
+	})
+
+	fmt.Fprintln(output, "### Fastest-growing metrics")
+	if len(growing) == 0 {
+		fmt.Fprintln(output, "No metric grew.")
+		return
+	}
+	fmt.Fprintln(output, "| Segment | Metric | First Raw Series | Last Raw Series | Growth |")
+	fmt.Fprintln(output, "|---------|--------|------------------|-----------------|--------|")
+	for _, span := range growing[:min(top, len(growing))] {
+		growth := span.last.RawSeries - span.first.RawSeries
+		percent := "new"
+		if span.first.RawSeries > 0 {
+			percent = fmt.Sprintf("%+.1f%%", float64(growth)/float64(span.first.RawSeries)*100)
+		}
+		fmt.Fprintf(output, "| %s | %s | %d | %d | %+d (%s) |\n", span.first.Segment, span.first.Metric, span.first.RawSeries, span.last.RawSeries, growth, percent)
+	}
+}
+
+// writeRealisedSavings lists, for the last pull of each day, how many series the rules in place at the time saved.
+func writeRealisedSavings(output io.Writer, records []historyRecord) {
+	type daily struct {
+		day          string
+		pull         time.Time
+		raw, current int
+	}
+
+	var days []*daily
+	for _, r := range records {
+		day := r.Time.UTC().Format(time.DateOnly)
+		if len(days) == 0 || days[len(days)-1].day != day {
+			days = append(days, &daily{day: day})
+		}
+		d := days[len(days)-1]
+		if !r.Time.Equal(d.pull) {
+			// A later pull of the same day replaces the earlier one.
+			*d = daily{day: day, pull: r.Time}
+		}
+		d.raw += r.RawSeries
+		d.current += r.CurrentSeries
+	}
+
+	fmt.Fprintln(output, "### Realised savings")
+	fmt.Fprintln(output, "| Date | Raw Series | Stored Series | Saved Series |")
+	fmt.Fprintln(output, "|------|------------|---------------|--------------|")
+	for _, d := range days {
+		saved := d.raw - d.current
+		percent := 0.0
+		if d.raw > 0 {
+			percent = float64(saved) / float64(d.raw) * 100
+		}
+		fmt.Fprintf(output, "| %s | %d | %d | %d (%.1f%%) |\n", d.day, d.raw, d.current, saved, percent)
+	}
+}
+
+// writeUnstableRecommendations lists the metrics whose recommended rule changed at least minChanges times.
+func writeUnstableRecommendations(output io.Writer, records []historyRecord, top, minChanges int) {
+	var unstable []*historySpan
+	for _, span := range historySpans(records) {
+		if span.changes >= minChanges {
+			unstable = append(unstable, span)
+		}
+	}
+	slices.SortStableFunc(unstable, func(a, b *historySpan) int {
+		return b.changes - a.changes
+	})
+
+	fmt.Fprintln(output, "### Unstable recommendations")
+	if len(unstable) == 0 {
+		fmt.Fprintf(output, "No recommendation changed %d times or more.\n", minChanges)
+		return
+	}
+	fmt.Fprintln(output, "| Segment | Metric | Match Type | Changes | Last Action |")
+	fmt.Fprintln(output, "|---------|--------|------------|---------|-------------|")
+	for _, span := range unstable[:min(top, len(unstable))] {
+		fmt.Fprintf(output, "| %s | %s | %s | %d | %s |\n", span.first.Segment, span.first.Metric, span.first.MatchType, span.changes, span.last.Action)
+	}
+}
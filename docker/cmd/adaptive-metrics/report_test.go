@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHistorySpansChanges(t *testing.T) {
+	record := func(day int, action, ruleHash string) historyRecord {
+		return historyRecord{
+			Time:     time.Date(2024, 1, day, 0, 0, 0, 0, time.UTC),
+			Segment:  "default",
+			Metric:   "http_requests_total",
+			Action:   action,
+			RuleHash: ruleHash,
+		}
+	}
+
+	tests := []struct {
+		name    string
+		records []historyRecord
+		want    int
+	}{
+		{
+			name:    "adopted recommendation",
+			records: []historyRecord{record(1, "add", "a"), record(2, "keep", "a"), record(3, "keep", "a")},
+			want:    0,
+		},
+		{
+			name:    "updated recommendation",
+			records: []historyRecord{record(1, "keep", "a"), record(2, "update", "b"), record(3, "keep", "b")},
+			want:    1,
+		},
+		{
+			name:    "removed and added again",
+			records: []historyRecord{record(1, "keep", "a"), record(2, "remove", "a"), record(3, "add", "a")},
+			want:    2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spans := historySpans(tt.records)
+			if len(spans) != 1 {
+				t.Fatalf("historySpans() returned %d spans, want 1", len(spans))
+			}
+			if spans[0].changes != tt.want {
+				t.Errorf("changes = %d, want %d", spans[0].changes, tt.want)
+			}
+		})
+	}
+}
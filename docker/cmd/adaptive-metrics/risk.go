@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/grafana/adaptive-metrics-autoapply/docker/internal"
+)
+
+type riskLevel int
+
+const (
+	riskLow riskLevel = iota
+	riskMedium
+	riskHigh
+)
+
+var riskLevels = []riskLevel{riskHigh, riskMedium, riskLow}
+
+func (l riskLevel) String() string {
+	switch l {
+	case riskHigh:
+		return "high"
+	case riskMedium:
+		return "medium"
+	default:
+		return "low"
+	}
+}
+
+func parseRiskLevel(s string) (riskLevel, error) {
+	for _, l := range riskLevels {
+		if l.String() == s {
+			return l, nil
+		}
+	}
+	return riskLow, fmt.Errorf("unknown risk level %q, must be one of: low, medium, high", s)
+}
+
+// riskConfig scores the risk of a recommendation as its weighted usages, multiplied by a factor for what the
+// recommendation does to the metric. The score is then compared to the thresholds.
+type riskConfig struct {
+	UsageWeights usageWeights   `json:"usage_weights" yaml:"usage_weights"`
+	Factors      riskFactors    `json:"factors" yaml:"factors"`
+	Thresholds   riskThresholds `json:"thresholds" yaml:"thresholds"`
+}
+
+type riskFactors struct {
+	// Drop applies to recommendations that drop the metric entirely.
+	Drop float64 `json:"drop" yaml:"drop"`
+	// Labels applies to recommendations that drop labels, or only keep some.
+	Labels float64 `json:"labels" yaml:"labels"`
+	// Aggregation applies to the other recommendations that add or update a rule.
+	Aggregation float64 `json:"aggregation" yaml:"aggregation"`
+	// Remove applies to recommendations that remove a rule, restoring the raw series.
+	Remove float64 `json:"remove" yaml:"remove"`
+}
+
+type riskThresholds struct {
+	High   float64 `json:"high" yaml:"high"`
+	Medium float64 `json:"medium" yaml:"medium"`
+}
+
+// defaultRiskConfig rates dropping a metric that's still queried, or dropping labels of a metric used in rules, as
+// high risk.
+var defaultRiskConfig = riskConfig{
+	UsageWeights: defaultUsageWeights,
+	Factors: riskFactors{
+		Drop:        10,
+		Labels:      5,
+		Aggregation: 1,
+		Remove:      0,
+	},
+	Thresholds: riskThresholds{
+		High:   10,
+		Medium: 3,
+	},
+}
+
+// readRiskConfig reads the risk config from file. Settings it leaves out keep their default.
+func readRiskConfig(file string) (*riskConfig, error) {
+	r, err := readConfigFile[struct {
+		UsageWeights *usageWeights   `json:"usage_weights" yaml:"usage_weights"`
+		Factors      *riskFactors    `json:"factors" yaml:"factors"`
+		Thresholds   *riskThresholds `json:"thresholds" yaml:"thresholds"`
+	}](file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read risk config: %w", err)
+	}
+
+	config := defaultRiskConfig
+	if r.UsageWeights != nil {
+		config.UsageWeights = *r.UsageWeights
+	}
+	if r.Factors != nil {
+		config.Factors = *r.Factors
+	}
+	if r.Thresholds != nil {
+		config.Thresholds = *r.Thresholds
+	}
+	if config.Thresholds.Medium > config.Thresholds.High {
+		return nil, fmt.Errorf("invalid risk config: the medium threshold is above the high threshold")
+	}
+	return &config, nil
+}
+
+func (c *riskConfig) score(rec internal.Recommendation) float64 {
+	factor := c.Factors.Aggregation
+	switch {
+	case rec.RecommendedAction == "remove":
+		factor = c.Factors.Remove
+	case rec.Drop:
+		factor = c.Factors.Drop
+	case len(rec.DropLabels) > 0 || len(rec.KeepLabels) > 0:
+		factor = c.Factors.Labels
+	}
+	return c.UsageWeights.risk(rec) * factor
+}
+
+func (c *riskConfig) level(score float64) riskLevel {
+	switch {
+	case score >= c.Thresholds.High:
+		return riskHigh
+	case score >= c.Thresholds.Medium:
+		return riskMedium
+	default:
+		return riskLow
+	}
+}
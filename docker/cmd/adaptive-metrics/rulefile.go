@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/grafana/adaptive-metrics-autoapply/docker/internal"
+)
+
+type ruleFileFormat string
+
+const (
+	formatJSON ruleFileFormat = "json"
+	formatYAML ruleFileFormat = "yaml"
+)
+
+// ruleFileExtensions lists the extensions recognised as rule files, in the order they are looked up.
+var ruleFileExtensions = []string{".json", ".yaml", ".yml"}
+
+func parseRuleFileFormat(s string) (ruleFileFormat, error) {
+	switch strings.ToLower(s) {
+	case "json":
+		return formatJSON, nil
+	case "yaml", "yml":
+		return formatYAML, nil
+	default:
+		return "", fmt.Errorf("unknown format %q, must be one of: json, yaml", s)
+	}
+}
+
+func formatFromPath(path string) ruleFileFormat {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return formatYAML
+	default:
+		return formatJSON
+	}
+}
+
+func (f ruleFileFormat) extension() string {
+	if f == formatYAML {
+		return ".yaml"
+	}
+	return ".json"
+}
+
+// segmentFileStem is the name segment files had before the manifest, which is still used to find them without one.
+func segmentFileStem(segment internal.Segment) string {
+	if segment == internal.DefaultSegment {
+		return "recommendations"
+	}
+	return fmt.Sprintf("recommendations-%s", segment.Name)
+}
+
+// findSegmentFile returns the rule file for the segment in dir, whatever its extension.
+// It returns an os.ErrNotExist error if there is none, and fails if more than one format is present.
+func findSegmentFile(dir string, segment internal.Segment) (string, error) {
+	var found []string
+	for _, ext := range ruleFileExtensions {
+		path := filepath.Join(dir, segmentFileStem(segment)+ext)
+		if _, err := os.Stat(path); err == nil {
+			found = append(found, path)
+		} else if !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("no rule file for segment %q: %w", segment.Name, os.ErrNotExist)
+	case 1:
+		return found[0], nil
+	default:
+		return "", fmt.Errorf("multiple rule files for segment %q: %s", segment.Name, strings.Join(found, ", "))
+	}
+}
+
+// readSegmentRules reads the local rules for the segment from dir. A segment without a rule file has no rules.
+func readSegmentRules(dir string, manifest *segmentManifest, segment internal.Segment) ([]internal.Recommendation, error) {
+	files, err := manifest.segmentFiles(dir, segment)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Printf("no rules found for segment %q", segment.Name)
+		return []internal.Recommendation{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return mergeRuleFiles(files)
+}
+
+// mergeRuleFiles concatenates the rules of the files in the given order. A metric and match type may only be
+// defined once across all files, since it's otherwise ambiguous which definition wins.
+func mergeRuleFiles(files []string) ([]internal.Recommendation, error) {
+	rules, _, err := mergeRuleFilesWithSources(files)
+	return rules, err
+}
+
+// mergeRuleFilesWithSources is mergeRuleFiles, and also returns the file each rule is defined in by its ruleKey.
+func mergeRuleFilesWithSources(files []string) ([]internal.Recommendation, map[string]string, error) {
+	rules := []internal.Recommendation{}
+	definedIn := map[string]string{}
+	for _, file := range files {
+		fileRules, err := readRulesFile(file)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read %s: %w", file, err)
+		}
+
+		for _, rule := range fileRules {
+			key := ruleKey(rule)
+			if other, ok := definedIn[key]; ok {
+				return nil, nil, fmt.Errorf("conflicting rules for metric %q with match type %s in %s and %s", rule.Metric, matchTypeOf(rule), other, file)
+			}
+			definedIn[key] = file
+			rules = append(rules, rule)
+		}
+	}
+	return rules, definedIn, nil
+}
+
+func readRulesFile(path string) ([]internal.Recommendation, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return decodeRules(path, data)
+}
+
+// decodeRules decodes the content of a rule file in the format matching the extension of path.
+func decodeRules(path string, data []byte) ([]internal.Recommendation, error) {
+	var rules []internal.Recommendation
+	var err error
+	if formatFromPath(path) == formatYAML {
+		rules, err = decodeYAML[[]internal.Recommendation](bytes.NewReader(data))
+	} else {
+		rules, err = decodeJSON[[]internal.Recommendation](bytes.NewReader(data))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Empty files decode to nil, which would be sent to the API as null rather than an empty rule set.
+	if rules == nil {
+		rules = []internal.Recommendation{}
+	}
+	return rules, nil
+}
+
+// marshalRules encodes the rules in the format matching the extension of path. previous is the file the rules were
+// written to before, which differs from path when the format or layout changes. It may be empty.
+func marshalRules(path, previous string, rules []internal.RuleData) ([]byte, error) {
+	if formatFromPath(path) == formatYAML {
+		return marshalYAMLRules(path, previous, rules)
+	}
+	return json.MarshalIndent(rules, "", "  ")
+}
+
+func readYAMLFile[T any](path string) (T, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		var result T
+		return result, err
+	}
+	defer func() { _ = file.Close() }()
+
+	return decodeYAML[T](file)
+}
+
+func decodeYAML[T any](r io.Reader) (T, error) {
+	var result T
+	// An empty YAML document is valid and means no rules.
+	err := yaml.NewDecoder(r).Decode(&result)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return result, err
+	}
+
+	return result, nil
+}
+
+// readConfigFile reads a JSON or YAML file, depending on the extension of path.
+func readConfigFile[T any](path string) (T, error) {
+	if formatFromPath(path) == formatYAML {
+		return readYAMLFile[T](path)
+	}
+	return readJSONFile[T](path)
+}
+
+// marshalYAMLRules encodes the rules as YAML. Comments from the existing file at path, or else from the previous YAML
+// file, are carried over to the rules with the same metric and match type, so that annotations survive a re-pull.
+func marshalYAMLRules(path, previous string, rules []internal.RuleData) ([]byte, error) {
+	var doc yaml.Node
+	if err := doc.Encode(rules); err != nil {
+		return nil, err
+	}
+
+	old, err := os.ReadFile(path)
+	if os.IsNotExist(err) && previous != "" && formatFromPath(previous) == formatYAML {
+		old, err = os.ReadFile(previous)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(old) > 0 {
+		var oldDoc yaml.Node
+		// An unparsable file is about to be overwritten anyway, so there is nothing worth preserving.
+		if yaml.Unmarshal(old, &oldDoc) == nil {
+			copyRuleComments(&doc, &oldDoc)
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	enc := yaml.NewEncoder(buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func copyRuleComments(dst, src *yaml.Node) {
+	// The file-level comments end up on the top level sequence.
+	dst.HeadComment = src.HeadComment
+	dst.FootComment = src.FootComment
+
+	if src.Kind == yaml.DocumentNode {
+		if len(src.Content) == 0 {
+			return
+		}
+		src = src.Content[0]
+	}
+	if src.Kind != yaml.SequenceNode {
+		return
+	}
+
+	oldRules := map[string]*yaml.Node{}
+	for _, item := range src.Content {
+		oldRules[yamlRuleKey(item)] = item
+	}
+
+	for _, item := range dst.Content {
+		if old, ok := oldRules[yamlRuleKey(item)]; ok {
+			copyNodeComments(item, old)
+		}
+	}
+}
+
+func yamlRuleKey(item *yaml.Node) string {
+	var metric, matchType string
+	if item.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(item.Content); i += 2 {
+			switch item.Content[i].Value {
+			case "metric":
+				metric = item.Content[i+1].Value
+			case "match_type":
+				matchType = item.Content[i+1].Value
+			}
+		}
+	}
+	if matchType == "" {
+		matchType = "exact"
+	}
+	return matchType + "/" + metric
+}
+
+func copyNodeComments(dst, src *yaml.Node) {
+	dst.HeadComment = src.HeadComment
+	dst.LineComment = src.LineComment
+	dst.FootComment = src.FootComment
+
+	if dst.Kind != src.Kind {
+		return
+	}
+
+	switch dst.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(dst.Content); i += 2 {
+			for j := 0; j+1 < len(src.Content); j += 2 {
+				if dst.Content[i].Value == src.Content[j].Value {
+					copyNodeComments(dst.Content[i], src.Content[j])
+					copyNodeComments(dst.Content[i+1], src.Content[j+1])
+					break
+				}
+			}
+		}
+	case yaml.SequenceNode:
+		for _, d := range dst.Content {
+			for _, s := range src.Content {
+				if d.Kind == yaml.ScalarNode && d.Value == s.Value {
+					copyNodeComments(d, s)
+					break
+				}
+			}
+		}
+	}
+}
+
+func readJSONFile[T any](path string) (T, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		var result T
+		return result, err
+	}
+	defer func() { _ = file.Close() }()
+
+	return decodeJSON[T](file)
+}
+
+func decodeJSON[T any](r io.Reader) (T, error) {
+	var result T
+	err := json.NewDecoder(r).Decode(&result)
+	if err != nil {
+		return result, err
+	}
+
+	return result, nil
+}
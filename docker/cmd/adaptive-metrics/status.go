@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/grafana/adaptive-metrics-autoapply/docker/internal"
+)
+
+const unmanagedRule = "(none)"
+
+type syncState string
+
+const (
+	syncInSync  syncState = "in-sync"
+	syncPending syncState = "pending"
+	syncNoLocal syncState = "no-local-rules"
+	syncUnknown syncState = "unknown"
+)
+
+// segmentStatus is the inventory of the rules applied to a segment, and how they compare to the local rule files.
+type segmentStatus struct {
+	Segment    string         `json:"segment"`
+	ID         string         `json:"id,omitempty"`
+	Rules      int            `json:"rules"`
+	ETag       string         `json:"etag"`
+	ManagedBy  map[string]int `json:"managed_by"`
+	MatchTypes map[string]int `json:"match_types"`
+	Kinds      map[string]int `json:"kinds"`
+	Sync       ruleSync       `json:"sync"`
+}
+
+// ruleSync counts the changes applying the local rule files would make.
+type ruleSync struct {
+	State     syncState `json:"state"`
+	Added     int       `json:"added,omitempty"`
+	Removed   int       `json:"removed,omitempty"`
+	Modified  int       `json:"modified,omitempty"`
+	Reordered bool      `json:"reordered,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// status lists the rules that are live in each segment, who manages them, and whether they match the local files.
+func status(args []string) {
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+	cfg := loadConfig(flags, args)
+	workingDir := flags.String("working-dir", cfg.get(settingWorkingDir), "The path to the working directory.")
+	userAgent := flags.String("user-agent", cfg.get(settingUserAgent), "The user-agent to use when making requests against the API.")
+	outputFormat := flags.String("output", "table", "The output format, table or json.")
+
+	err := flags.Parse(args)
+	if err != nil {
+		log.Fatalf("failed to parse flags: %v", err)
+	}
+	if *outputFormat != "table" && *outputFormat != "json" {
+		log.Fatalf("invalid -output %q, must be one of: table, json", *outputFormat)
+	}
+
+	c := newClient(cfg, *userAgent)
+
+	segments, err := c.FetchSegments()
+	if err != nil {
+		log.Fatalf("failed to fetch segments: %v", err)
+	}
+	segments = append(segments, internal.DefaultSegment)
+
+	manifest, err := readSegmentManifest(*workingDir)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	statuses := []segmentStatus{}
+	for _, segment := range segments {
+		rules, etag, err := c.GetRules(segment)
+		if err != nil {
+			log.Fatalf("failed to get the rules of segment %s: %v", segment.Name, err)
+		}
+
+		s := newSegmentStatus(segment, rules, etag)
+		s.Sync = syncWithLocalRules(*workingDir, manifest, segment, rules)
+		statuses = append(statuses, s)
+	}
+
+	if *outputFormat == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(struct {
+			Segments []segmentStatus `json:"segments"`
+		}{statuses})
+		if err != nil {
+			log.Fatalf("failed to write status: %v", err)
+		}
+		return
+	}
+	writeStatus(os.Stdout, statuses)
+}
+
+func newSegmentStatus(segment internal.Segment, rules []internal.Recommendation, etag string) segmentStatus {
+	s := segmentStatus{
+		Segment:    segment.Name,
+		ID:         segment.Identifier,
+		Rules:      len(rules),
+		ETag:       etag,
+		ManagedBy:  map[string]int{},
+		MatchTypes: map[string]int{},
+		Kinds:      map[string]int{},
+	}
+	for _, rule := range rules {
+		managedBy := rule.ManagedBy
+		if managedBy == "" {
+			managedBy = unmanagedRule
+		}
+		s.ManagedBy[managedBy]++
+		s.MatchTypes[matchTypeOf(rule)]++
+		s.Kinds[ruleKind(rule.RuleData)]++
+	}
+	return s
+}
+
+// ruleKind describes what a rule does to the series of a metric.
+func ruleKind(rule internal.RuleData) string {
+	switch {
+	case rule.Drop:
+		return "drop"
+	case len(rule.KeepLabels) > 0:
+		return "keep_labels"
+	case len(rule.DropLabels) > 0:
+		return "drop_labels"
+	default:
+		return "aggregation-only"
+	}
+}
+
+// syncWithLocalRules compares the remote rules of the segment with its local rule files. managed_by is ignored,
+// since apply sets it.
+func syncWithLocalRules(dir string, manifest *segmentManifest, segment internal.Segment, remote []internal.Recommendation) ruleSync {
+	files, err := manifest.segmentFiles(dir, segment)
+	if errors.Is(err, os.ErrNotExist) {
+		return ruleSync{State: syncNoLocal}
+	}
+	var local []internal.Recommendation
+	if err == nil {
+		local, err = mergeRuleFiles(files)
+	}
+	if err != nil {
+		return ruleSync{State: syncUnknown, Error: err.Error()}
+	}
+
+	diff := diffSegment(segment, withoutManagedBy(remote), withoutManagedBy(local))
+	sync := ruleSync{State: syncInSync, Reordered: diff.order != nil}
+	for _, change := range diff.changes {
+		switch change.Type {
+		case changeAdd:
+			sync.Added++
+		case changeRemove:
+			sync.Removed++
+		case changeModify:
+			sync.Modified++
+		}
+	}
+	if diff.count() > 0 {
+		sync.State = syncPending
+	}
+	return sync
+}
+
+func withoutManagedBy(rules []internal.Recommendation) []internal.Recommendation {
+	stripped := make([]internal.Recommendation, len(rules))
+	for i, rule := range rules {
+		rule.ManagedBy = ""
+		stripped[i] = rule
+	}
+	return stripped
+}
+
+func (s ruleSync) String() string {
+	switch s.State {
+	case syncPending:
+		var changes []string
+		for _, c := range []struct {
+			n    int
+			verb string
+		}{{s.Added, "added"}, {s.Removed, "removed"}, {s.Modified, "modified"}} {
+			if c.n > 0 {
+				changes = append(changes, fmt.Sprintf("%d %s", c.n, c.verb))
+			}
+		}
+		if s.Reordered {
+			changes = append(changes, "reordered")
+		}
+		return fmt.Sprintf("%s (%s)", s.State, strings.Join(changes, ", "))
+	case syncUnknown:
+		return fmt.Sprintf("%s (%s)", s.State, s.Error)
+	default:
+		return string(s.State)
+	}
+}
+
+func writeStatus(w io.Writer, statuses []segmentStatus) {
+	total := segmentStatus{Segment: "All segments", ManagedBy: map[string]int{}, MatchTypes: map[string]int{}, Kinds: map[string]int{}}
+	fmt.Fprintln(w, "| Segment | Rules | ETag | Managed By | Match Types | Kinds | Local Files |")
+	fmt.Fprintln(w, "|---------|-------|------|------------|-------------|-------|-------------|")
+	for _, s := range statuses {
+		fmt.Fprintf(w, "| %s | %d | %s | %s | %s | %s | %s |\n", s.Segment, s.Rules, s.ETag, formatCounts(s.ManagedBy), formatCounts(s.MatchTypes), formatCounts(s.Kinds), s.Sync)
+
+		total.Rules += s.Rules
+		for _, m := range []struct{ dst, src map[string]int }{{total.ManagedBy, s.ManagedBy}, {total.MatchTypes, s.MatchTypes}, {total.Kinds, s.Kinds}} {
+			for k, v := range m.src {
+				m.dst[k] += v
+			}
+		}
+	}
+	fmt.Fprintf(w, "| %s | %d | | %s | %s | %s | |\n", total.Segment, total.Rules, formatCounts(total.ManagedBy), formatCounts(total.MatchTypes), formatCounts(total.Kinds))
+}
+
+// formatCounts lists the counts sorted by key, such as "drop: 2, keep_labels: 1".
+func formatCounts(counts map[string]int) string {
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	var parts []string
+	for _, k := range keys {
+		parts = append(parts, fmt.Sprintf("%s: %d", k, counts[k]))
+	}
+	return strings.Join(parts, ", ")
+}
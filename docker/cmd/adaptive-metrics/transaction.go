@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+const stagingDirName = ".adaptive-metrics-staging"
+
+// fileTransaction stages files in a directory next to their destination, and only moves them into place on commit,
+// so that a failure halfway leaves the existing files untouched. The staging directory is inside the working directory,
+// so that files can be renamed into place, and ignores itself, so that it's never committed to the repository.
+type fileTransaction struct {
+	dir        string
+	stagingDir string
+
+	staged   []string
+	removals []string
+}
+
+func newFileTransaction(dir string) (*fileTransaction, error) {
+	stagingDir := filepath.Join(dir, stagingDirName)
+
+	// Clean up after a previous run that didn't get to roll back.
+	if err := os.RemoveAll(stagingDir); err != nil {
+		return nil, err
+	}
+	if err := os.Mkdir(stagingDir, 0755); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(stagingDir, ".gitignore"), []byte("*\n"), 0644); err != nil {
+		return nil, err
+	}
+
+	return &fileTransaction{
+		dir:        dir,
+		stagingDir: stagingDir,
+	}, nil
+}
+
+// write stages the content of the file with the given name, relative to the transaction's directory.
+func (t *fileTransaction) write(name string, data []byte) error {
+	if slices.Contains(t.staged, name) {
+		return fmt.Errorf("%s is written more than once", name)
+	}
+
+	path := t.stagedPath(name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return err
+	}
+
+	t.staged = append(t.staged, name)
+	return nil
+}
+
+// remove schedules the file or directory with the given name for removal on commit.
+func (t *fileTransaction) remove(name string) {
+	t.removals = append(t.removals, name)
+}
+
+func (t *fileTransaction) written(name string) bool {
+	return slices.Contains(t.staged, name)
+}
+
+func (t *fileTransaction) stagedPath(name string) string {
+	return filepath.Join(t.stagingDir, "new", name)
+}
+
+func (t *fileTransaction) backupPath(name string) string {
+	return filepath.Join(t.stagingDir, "old", name)
+}
+
+// commit moves all staged files into place, then removes the files scheduled for removal. The files it replaces or
+// removes are moved to backups first. If any step fails, every step so far is undone, so that the directory is left
+// either fully updated or as it was.
+func (t *fileTransaction) commit() error {
+	var undo []func() error
+	err := t.apply(&undo)
+	if err == nil {
+		t.rollback()
+		return nil
+	}
+
+	var errs []error
+	for i := len(undo) - 1; i >= 0; i-- {
+		errs = append(errs, undo[i]())
+	}
+	if undoErr := errors.Join(errs...); undoErr != nil {
+		// Keep the backups, the working directory can only be restored by hand from here on.
+		return fmt.Errorf("%w, and failed to restore the previous files, find them in %s: %v", err, t.backupPath(""), undoErr)
+	}
+	t.rollback()
+	return err
+}
+
+// apply makes the changes of the transaction, recording how to undo each of them in undo.
+func (t *fileTransaction) apply(undo *[]func() error) error {
+	for _, name := range t.staged {
+		path := filepath.Join(t.dir, name)
+		if err := t.mkdirAll(filepath.Dir(path), undo); err != nil {
+			return err
+		}
+		if err := t.backup(name, undo); err != nil {
+			return err
+		}
+		if err := os.Rename(t.stagedPath(name), path); err != nil {
+			return err
+		}
+		*undo = append(*undo, func() error { return os.Rename(path, t.stagedPath(name)) })
+	}
+
+	for _, name := range t.removals {
+		if t.written(name) {
+			continue
+		}
+		if err := t.backup(name, undo); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// backup moves the existing file or directory with the given name out of the way, if there is one.
+func (t *fileTransaction) backup(name string, undo *[]func() error) error {
+	path := filepath.Join(t.dir, name)
+	if _, err := os.Lstat(path); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	backup := t.backupPath(name)
+	if err := os.MkdirAll(filepath.Dir(backup), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(path, backup); err != nil {
+		return err
+	}
+	*undo = append(*undo, func() error { return os.Rename(backup, path) })
+	return nil
+}
+
+// mkdirAll creates dir and its missing parents, recording how to remove the ones it created.
+func (t *fileTransaction) mkdirAll(dir string, undo *[]func() error) error {
+	var missing []string
+	for d := filepath.Clean(dir); d != filepath.Clean(t.dir) && d != filepath.Dir(d); d = filepath.Dir(d) {
+		if _, err := os.Stat(d); err == nil {
+			break
+		}
+		missing = append(missing, d)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	// Undo runs in reverse, so record the outermost directory first to remove the innermost one first.
+	for i := len(missing) - 1; i >= 0; i-- {
+		d := missing[i]
+		*undo = append(*undo, func() error { return os.Remove(d) })
+	}
+	return nil
+}
+
+// rollback discards everything staged so far, and the backups once they're no longer needed.
+func (t *fileTransaction) rollback() {
+	_ = os.RemoveAll(t.stagingDir)
+}
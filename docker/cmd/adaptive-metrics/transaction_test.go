@@ -0,0 +1,99 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileTransactionCommit(t *testing.T) {
+	dir := t.TempDir()
+	mustWriteFile(t, filepath.Join(dir, "a.json"), "old a")
+	mustWriteFile(t, filepath.Join(dir, "orphan.json"), "orphan")
+
+	tx, err := newFileTransaction(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustStage(t, tx, "a.json", "new a")
+	mustStage(t, tx, "segments/b/recommended.json", "new b")
+	tx.remove("orphan.json")
+
+	if err := tx.commit(); err != nil {
+		t.Fatalf("commit() error = %v", err)
+	}
+
+	assertFile(t, filepath.Join(dir, "a.json"), "new a")
+	assertFile(t, filepath.Join(dir, "segments/b/recommended.json"), "new b")
+	assertNotExist(t, filepath.Join(dir, "orphan.json"))
+	assertNotExist(t, filepath.Join(dir, stagingDirName))
+}
+
+func TestFileTransactionCommitRollsBack(t *testing.T) {
+	dir := t.TempDir()
+	mustWriteFile(t, filepath.Join(dir, "a.json"), "old a")
+	mustWriteFile(t, filepath.Join(dir, "orphan.json"), "orphan")
+	// A file where a directory is needed makes the last write fail after the others were moved into place.
+	mustWriteFile(t, filepath.Join(dir, "blocked"), "not a directory")
+
+	tx, err := newFileTransaction(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustStage(t, tx, "a.json", "new a")
+	mustStage(t, tx, "segments/b/recommended.json", "new b")
+	mustStage(t, tx, "blocked/c.json", "new c")
+	tx.remove("orphan.json")
+
+	if err := tx.commit(); err == nil {
+		t.Fatal("commit() error = nil")
+	}
+
+	assertFile(t, filepath.Join(dir, "a.json"), "old a")
+	assertFile(t, filepath.Join(dir, "orphan.json"), "orphan")
+	assertFile(t, filepath.Join(dir, "blocked"), "not a directory")
+	assertNotExist(t, filepath.Join(dir, "segments"))
+	assertNotExist(t, filepath.Join(dir, stagingDirName))
+}
+
+func TestFileTransactionIgnoresStagingDir(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := newFileTransaction(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	// A crash before commit or rollback leaves the staging directory behind, which git must not pick up.
+	assertFile(t, filepath.Join(dir, stagingDirName, ".gitignore"), "*\n")
+}
+
+func mustStage(t *testing.T, tx *fileTransaction, name, content string) {
+	t.Helper()
+	if err := tx.write(name, []byte(content)); err != nil {
+		t.Fatalf("write(%s) error = %v", name, err)
+	}
+}
+
+func mustWriteFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func assertFile(t *testing.T, path, want string) {
+	t.Helper()
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read %s: %v", path, err)
+	}
+	if string(got) != want {
+		t.Errorf("%s = %q, want %q", path, got, want)
+	}
+}
+
+func assertNotExist(t *testing.T, path string) {
+	t.Helper()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("%s exists, want it removed (stat error = %v)", path, err)
+	}
+}
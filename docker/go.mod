@@ -5,9 +5,13 @@ go 1.22.5
 require (
 	github.com/google/go-cmp v0.6.0
 	github.com/prometheus/common v0.55.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
+	// gopkg.in/yaml.v3's tests import gopkg.in/check.v1 at a version without a go.mod, so go mod tidy has to pin
+	// the packages it imports itself.
+	github.com/kr/pretty v0.3.1 // indirect
 	github.com/prometheus/client_model v0.6.1 // indirect
 	google.golang.org/protobuf v1.34.2 // indirect
 )
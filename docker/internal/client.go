@@ -33,6 +33,9 @@ func (c *Client) FetchSegments() ([]Segment, error) {
 		return nil, err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, newStatusError(resp)
+	}
 
 	var segments []Segment
 	if err = json.NewDecoder(resp.Body).Decode(&segments); err != nil {
@@ -51,6 +54,9 @@ func (c *Client) FetchRecommendations(segment Segment, verbose bool) ([]Recommen
 		return nil, err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, newStatusError(resp)
+	}
 
 	var recs []Recommendation
 	if err = json.NewDecoder(resp.Body).Decode(&recs); err != nil {
@@ -73,12 +79,7 @@ func (c *Client) ValidateRules(rules []Recommendation) error {
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		bodyBuf, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
-		if err != nil {
-			return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
-		}
-
-		return fmt.Errorf("unexpected status code: %d with body %q", resp.StatusCode, bodyBuf)
+		return newStatusError(resp)
 	}
 
 	return nil
@@ -93,7 +94,7 @@ func (c *Client) GetRules(segment Segment) ([]Recommendation, string, error) {
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		return nil, "", fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+		return nil, "", newStatusError(resp)
 	}
 
 	etag := resp.Header.Get("ETag")
@@ -120,17 +121,31 @@ func (c *Client) UpdateRules(segment Segment, etag string, rules []Recommendatio
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		bodyBuf, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
-		if err != nil {
-			return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
-		}
-
-		return fmt.Errorf("unexpected status code: %d with body %q", resp.StatusCode, bodyBuf)
+		return newStatusError(resp)
 	}
 
 	return nil
 }
 
+// StatusError is returned for responses with an unexpected status code.
+type StatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	if e.Body == "" {
+		return fmt.Sprintf("unexpected status code: %d", e.StatusCode)
+	}
+	return fmt.Sprintf("unexpected status code: %d with body %q", e.StatusCode, e.Body)
+}
+
+func newStatusError(resp *http.Response) error {
+	// The body is only there to help debugging, so a failure to read it doesn't matter.
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return &StatusError{StatusCode: resp.StatusCode, Body: string(body)}
+}
+
 func (c *Client) makeNewRequest(method, subPath string, queryParams url.Values, headers http.Header, body io.Reader) (*http.Response, error) {
 	p := fmt.Sprintf("%s/%s", c.apiURL, subPath)
 	if queryParams != nil {
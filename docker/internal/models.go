@@ -31,23 +31,23 @@ type RuleData struct {
 
 	Ingest bool `json:"ingest,omitempty" yaml:"ingest,omitempty"`
 
-	ManagedBy string `json:"managed_by,omitempty"`
+	ManagedBy string `json:"managed_by,omitempty" yaml:"managed_by,omitempty"`
 }
 
 type Recommendation struct {
-	RuleData
+	RuleData `yaml:",inline"`
 
-	RecommendedAction  string `json:"recommended_action,omitempty"`
-	UsagesInRules      int    `json:"usages_in_rules,omitempty"`
-	UsagesInQueries    int    `json:"usages_in_queries,omitempty"`
-	UsagesInDashboards int    `json:"usages_in_dashboards,omitempty"`
+	RecommendedAction  string `json:"recommended_action,omitempty" yaml:"recommended_action,omitempty"`
+	UsagesInRules      int    `json:"usages_in_rules,omitempty" yaml:"usages_in_rules,omitempty"`
+	UsagesInQueries    int    `json:"usages_in_queries,omitempty" yaml:"usages_in_queries,omitempty"`
+	UsagesInDashboards int    `json:"usages_in_dashboards,omitempty" yaml:"usages_in_dashboards,omitempty"`
 
 	// Used when recommended action is "add"
-	KeptLabels []string `json:"kept_labels,omitempty"`
+	KeptLabels []string `json:"kept_labels,omitempty" yaml:"kept_labels,omitempty"`
 
-	RawSeriesCount         int `json:"raw_series_count,omitempty"`         // Number of series the client is sending.
-	CurrentSeriesCount     int `json:"current_series_count,omitempty"`     // Number of series stored in the database.
-	RecommendedSeriesCount int `json:"recommended_series_count,omitempty"` // Number of series after applying the recommendation.
+	RawSeriesCount         int `json:"raw_series_count,omitempty" yaml:"raw_series_count,omitempty"`                 // Number of series the client is sending.
+	CurrentSeriesCount     int `json:"current_series_count,omitempty" yaml:"current_series_count,omitempty"`         // Number of series stored in the database.
+	RecommendedSeriesCount int `json:"recommended_series_count,omitempty" yaml:"recommended_series_count,omitempty"` // Number of series after applying the recommendation.
 }
 
 func ConvertVerboseToRules(recs []Recommendation) []RuleData {